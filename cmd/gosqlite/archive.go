@@ -0,0 +1,316 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+var ErrArchiveFormat = errors.New("archive must be tar or zip")
+
+type entryKind int
+
+const (
+	entryFile entryKind = iota
+	entryDir
+	entryLink
+	entryOther
+	entrySkip
+)
+
+// An entry of an archive, whatever the format of the archive
+type archiveEntry struct {
+	name string
+	kind entryKind
+	body io.Reader
+}
+
+type archiveReader interface {
+	// Returns io.EOF after the last entry
+	Next() (*archiveEntry, error)
+}
+
+type tarArchive struct {
+	t *tar.Reader
+}
+
+func (a *tarArchive) Next() (*archiveEntry, error) {
+	header, err := a.t.Next()
+	if err != nil {
+		return nil, err
+	}
+	entry := &archiveEntry{name: header.Name, body: a.t}
+	switch header.Typeflag {
+	case tar.TypeReg, tar.TypeRegA:
+		entry.kind = entryFile
+	case tar.TypeDir:
+		entry.kind = entryDir
+	case tar.TypeSymlink, tar.TypeLink:
+		entry.kind = entryLink
+	case tar.TypeXGlobalHeader:
+		entry.kind = entrySkip
+	default:
+		entry.kind = entryOther
+	}
+	return entry, nil
+}
+
+type zipArchive struct {
+	z    *zip.Reader
+	i    int
+	prev io.Closer
+}
+
+func (a *zipArchive) Next() (*archiveEntry, error) {
+	if a.prev != nil {
+		a.prev.Close()
+		a.prev = nil
+	}
+	if a.i >= len(a.z.File) {
+		return nil, io.EOF
+	}
+	f := a.z.File[a.i]
+	a.i++
+	entry := &archiveEntry{name: f.Name}
+	mode := f.Mode()
+	switch {
+	case mode&os.ModeSymlink != 0:
+		entry.kind = entryLink
+	case mode.IsDir() || strings.HasSuffix(f.Name, "/"):
+		entry.kind = entryDir
+	case mode.IsRegular():
+		entry.kind = entryFile
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		a.prev = rc
+		entry.body = rc
+	default:
+		entry.kind = entryOther
+	}
+	return entry, nil
+}
+
+var (
+	zipMagic   = []byte("PK\x03\x04")
+	zipEmpty   = []byte("PK\x05\x06")
+	gzipMagic  = []byte{0x1f, 0x8b}
+	bzip2Magic = []byte("BZh")
+	zstdMagic  = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// Guess the format from the magic bytes, and then from the Content-Type.
+// Anything else is assumed to be a plain tar.
+func archiveFormat(head []byte, contentType string) string {
+	switch {
+	case bytes.HasPrefix(head, zipMagic) || bytes.HasPrefix(head, zipEmpty):
+		return "zip"
+	case bytes.HasPrefix(head, gzipMagic):
+		return "gzip"
+	case bytes.HasPrefix(head, bzip2Magic):
+		return "bzip2"
+	case bytes.HasPrefix(head, zstdMagic):
+		return "zstd"
+	}
+	switch strings.TrimSpace(strings.Split(contentType, ";")[0]) {
+	case "application/zip", "application/x-zip-compressed":
+		return "zip"
+	case "application/gzip", "application/x-gzip", "application/x-compressed-tar":
+		return "gzip"
+	case "application/x-bzip2", "application/x-bzip-compressed-tar":
+		return "bzip2"
+	case "application/zstd", "application/x-zstd", "application/x-zstd-compressed-tar":
+		return "zstd"
+	}
+	return "tar"
+}
+
+// Open an uploaded archive: zip, or a tar that may be compressed with gzip, bzip2 or zstd.
+// The returned cleanup must be called once the entries are read.
+func openArchive(stream io.Reader, contentType string) (archiveReader, func(), error) {
+	buffered := bufio.NewReader(stream)
+	head, _ := buffered.Peek(4)
+	cleanup := func() {}
+
+	switch archiveFormat(head, contentType) {
+	case "zip":
+		// zip keeps its directory at the end, so it needs the whole thing
+		f, err := ioutil.TempFile("", "install-*.zip")
+		if err != nil {
+			return nil, cleanup, err
+		}
+		cleanup = func() {
+			f.Close()
+			os.Remove(f.Name())
+		}
+		sz, err := io.Copy(f, buffered)
+		if err != nil {
+			return nil, cleanup, err
+		}
+		z, err := zip.NewReader(f, sz)
+		if err != nil {
+			return nil, cleanup, err
+		}
+		a := &zipArchive{z: z}
+		return a, func() {
+			if a.prev != nil {
+				a.prev.Close()
+			}
+			cleanup()
+		}, nil
+	case "gzip":
+		gz, err := gzip.NewReader(buffered)
+		if err != nil {
+			return nil, cleanup, err
+		}
+		return &tarArchive{t: tar.NewReader(gz)}, func() { gz.Close() }, nil
+	case "bzip2":
+		return &tarArchive{t: tar.NewReader(bzip2.NewReader(buffered))}, cleanup, nil
+	case "zstd":
+		zr, err := zstd.NewReader(buffered)
+		if err != nil {
+			return nil, cleanup, err
+		}
+		return &tarArchive{t: tar.NewReader(zr)}, zr.Close, nil
+	}
+	return &tarArchive{t: tar.NewReader(buffered)}, cleanup, nil
+}
+
+// Is name derived from another file, and so regenerated when that file is installed
+func isDerived(name string) bool {
+	for _, suffix := range derivedSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Write one entry of a subtree as it is walked, with names such as ./sub/a.txt,
+// so that the archive installs back into the same shape
+type archiveWriter func(name string, info os.FileInfo, fsName string) error
+
+func tarWriter(t *tar.Writer) archiveWriter {
+	return func(name string, info os.FileInfo, fsName string) error {
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = name
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		err = t.WriteHeader(header)
+		if err != nil || info.IsDir() {
+			return err
+		}
+		f, err := os.Open(fsName)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(t, f)
+		return err
+	}
+}
+
+func zipWriter(z *zip.Writer) archiveWriter {
+	return func(name string, info os.FileInfo, fsName string) error {
+		header, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+		header.Name = name
+		if info.IsDir() {
+			header.Name += "/"
+		} else {
+			header.Method = zip.Deflate
+		}
+		out, err := z.CreateHeader(header)
+		if err != nil || info.IsDir() {
+			return err
+		}
+		f, err := os.Open(fsName)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(out, f)
+		return err
+	}
+}
+
+// GET /files/app/v1/?archive=tar streams the subtree as a tar (or zip), with only what the user may read.
+// derived=false leaves out thumbnails, extracts and labels, which are made again on install.
+// fsPath begins with ./files/ and ends with a slash.
+func getArchiveHandler(w http.ResponseWriter, r *http.Request, fsPath string) {
+	user := GetUser(r)
+	q := r.URL.Query()
+	format := q.Get("archive")
+	withDerived := q.Get("derived") != "false"
+	base := path.Base(fsPath)
+
+	var write archiveWriter
+	var closer io.Closer
+	switch format {
+	case "tar":
+		w.Header().Set("Content-Type", "application/x-tar")
+		t := tar.NewWriter(w)
+		write, closer = tarWriter(t), t
+	case "zip":
+		w.Header().Set("Content-Type", "application/zip")
+		z := zip.NewWriter(w)
+		write, closer = zipWriter(z), z
+	default:
+		HandleReturnedStatus(w, http.StatusBadRequest, ErrArchiveFormat, "Could not archive %s: %v", fsPath)
+		return
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.%s"`, base, format))
+
+	root := filepath.Clean(fsPath)
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == root {
+			return nil
+		}
+		name := info.Name()
+		skip := isTempName(name) || (!withDerived && isDerived(name)) ||
+			!canReadEntry(user, "./"+filepath.ToSlash(filepath.Dir(p))+"/", info)
+		if skip && info.IsDir() {
+			return filepath.SkipDir
+		}
+		if skip {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		return write("./"+filepath.ToSlash(rel), info, p)
+	})
+	if err == nil {
+		err = closer.Close()
+	}
+	if err != nil {
+		// The headers are long gone, so all we can do is cut the archive short
+		log.Printf("ERR could not archive %s: %v", fsPath, err)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// Content is stored once under ./blobs by its sha256, and every file in the URL tree
+// with that content is a hard link to it.  So the files tree can still be served
+// straight off of the filesystem, and identical assets in many installed apps cost nothing.
+//
+//	./blobs/3a/3a7bd3e2360a3d29eea436fcfb7e44c735d117c42d1c1835420b6b9942dd4f1b
+//
+// A blob with only one link left is referenced by nothing, and is swept away.
+const blobsDir = "./blobs"
+
+func blobName(hash string) string {
+	return fmt.Sprintf("%s/%s/%s", blobsDir, hash[:2], hash)
+}
+
+func hashFile(fsName string) (string, int64, error) {
+	f, err := os.Open(fsName)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	sz, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), sz, nil
+}
+
+func linkCount(s os.FileInfo) uint64 {
+	if st, ok := s.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Nlink)
+	}
+	return 1
+}
+
+// Hash a file that was just written, and make it a link to its blob.
+// If the blob already exists, the file is replaced with a link to it.
+func storeBlob(fsName string) (string, int64, error) {
+	hash, sz, err := hashFile(fsName)
+	if err != nil {
+		return "", 0, err
+	}
+	blob := blobName(hash)
+	err = os.MkdirAll(filepath.Dir(blob), 0777)
+	if err != nil {
+		return "", 0, err
+	}
+	if _, err := os.Stat(blob); err == nil {
+		tmp := fsName + ".link"
+		os.Remove(tmp)
+		err = os.Link(blob, tmp)
+		if err == nil {
+			err = os.Rename(tmp, fsName)
+		}
+		if err != nil {
+			os.Remove(tmp)
+			log.Printf("could not link %s to blob %s: %v", fsName, hash, err)
+		}
+		return hash, sz, nil
+	}
+	err = os.Link(fsName, blob)
+	if err != nil && !os.IsExist(err) {
+		// ie: blobs on a different filesystem.  The file is still fine as it is.
+		log.Printf("could not store blob %s for %s: %v", hash, fsName, err)
+	}
+	return hash, sz, nil
+}
+
+// A file that is shared with a blob must be copied before it is appended to,
+// or the append would change every file that shares the blob
+func unshareBlob(fsName string) error {
+	s, err := os.Stat(fsName)
+	if err != nil || linkCount(s) < 2 {
+		return nil
+	}
+	src, err := os.Open(fsName)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	tmp := fsName + ".unshare"
+	dst, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	dst.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, fsName)
+}
+
+// The blobs of the catalogued files that match where, which are all that need to be swept once they are removed
+func catalogHashes(tx *sql.Tx, where string, args ...interface{}) ([]string, error) {
+	rows, err := tx.Query(`SELECT DISTINCT sha256 FROM filemeta WHERE coalesce(sha256, '') != '' AND (`+where+`)`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	hashes := []string{}
+	for rows.Next() {
+		var hash string
+		err = rows.Scan(&hash)
+		if err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, hash)
+	}
+	return hashes, rows.Err()
+}
+
+// The blobs that only files under fsName link to, for what is not catalogued, such as previous versions.
+// They have to be hashed to find their blob, but anything that is not a blob, or is shared with a
+// file that stays, is left alone.
+func unsharedHashes(fsName string) []string {
+	hashes := []string{}
+	filepath.Walk(fsName, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || linkCount(info) != 2 {
+			return nil
+		}
+		hash, _, err := hashFile(p)
+		if err != nil {
+			log.Printf("could not hash %s: %v", p, err)
+			return nil
+		}
+		hashes = append(hashes, hash)
+		return nil
+	})
+	return hashes
+}
+
+// Remove the blobs of hashes that nothing links to any longer, such as after a delete.
+// Only blobs that lost a link are looked at, so this costs no more as the store grows.
+func sweepBlobs(hashes []string) {
+	for _, hash := range hashes {
+		if _, err := hex.DecodeString(hash); err != nil || len(hash) != 2*sha256.Size {
+			continue
+		}
+		blob := blobName(hash)
+		s, err := os.Stat(blob)
+		if err != nil || linkCount(s) > 1 {
+			continue
+		}
+		err = os.Remove(blob)
+		if err != nil {
+			log.Printf("could not remove blob %s: %v", blob, err)
+		}
+	}
+}
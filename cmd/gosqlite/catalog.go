@@ -0,0 +1,219 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var ErrListSort = errors.New("sort must be one of name, path, size, created, modified or uploader")
+
+// Keep the filemeta row for a file that was just written by uploader.
+// created is kept from the first time the file was written, while modified is now.
+// Derived files and sidecars note the name of the file beside them that they belong to.
+func catalogFile(command string, parentDir string, name string, uploader string, contentType string, size int64, hash string) error {
+	now := time.Now().UTC().Format(time.RFC3339)
+	derivedOf := ""
+	if original := OriginalName(name); original != name {
+		derivedOf = original
+	}
+	tx, err := theDB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	// The blob of what this replaces may have nothing else linked to it now
+	previous := ""
+	err = tx.QueryRow(
+		`SELECT coalesce(sha256, '') FROM filemeta WHERE path = ? AND name = ?`,
+		parentDir+"/", name,
+	).Scan(&previous)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	result, err := tx.Exec(
+		`UPDATE filemeta SET cmd = ?, contentType = ?, contentSize = ?, sha256 = ?, uploader = ?, modified = ?, derivedOf = ?
+		 WHERE path = ? AND name = ?`,
+		command, contentType, size, hash, uploader, now, derivedOf, parentDir+"/", name,
+	)
+	if err != nil {
+		return err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		_, err = tx.Exec(
+			`INSERT INTO filemeta (cmd, path, name, contentType, contentSize, sha256, uploader, created, modified, derivedOf)
+			 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			command, parentDir+"/", name, contentType, size, hash, uploader, now, now, derivedOf,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	if previous != "" && previous != hash {
+		sweepBlobs([]string{previous})
+	}
+	return nil
+}
+
+// Store a file that was just written as a blob, and catalog it with its content type.
+// A file that is still being appended to has no hash, and is not stored as a blob until eof
+func catalogWrittenFile(command string, parentDir string, name string, uploader string, existingSize int64, sz int64) (string, error) {
+	var err error
+	fsName := "." + parentDir + "/" + name
+	hash := ""
+	if command != "append" {
+		hash, sz, err = storeBlob(fsName)
+		if err != nil {
+			return "", err
+		}
+	} else {
+		sz += existingSize
+	}
+	contentType, err := DetectContentType(fsName)
+	if err != nil {
+		return "", err
+	}
+	return contentType, catalogFile(command, parentDir, name, uploader, contentType, sz, hash)
+}
+
+// What a file is served with: the content hash makes a strong ETag, as it only changes
+// when the content does, and the content type is what was detected when it was written
+func catalogServing(parentDir string, name string) (string, string) {
+	hash, contentType := "", ""
+	err := theDB.QueryRow(
+		`SELECT coalesce(sha256, ''), coalesce(contentType, '') FROM filemeta WHERE path = ? AND name = ?`,
+		parentDir+"/", name,
+	).Scan(&hash, &contentType)
+	if err != nil && err != sql.ErrNoRows {
+		return "", ""
+	}
+	return hash, contentType
+}
+
+// Columns that a listing may be sorted by
+var listSorts = map[string]string{
+	"name":     "name",
+	"path":     "path",
+	"size":     "contentSize",
+	"created":  "created",
+	"modified": "modified",
+	"uploader": "uploader",
+}
+
+// GET /list/robf/docs lists the files catalogued in /files/robf/docs, without walking the filesystem.
+//
+//	recursive=true  - everything under it, rather than only what is directly in it
+//	sort=modified   - name (the default), path, size, created, modified or uploader
+//	order=desc      - asc (the default) or desc
+//	limit, offset   - a page of what the user may read
+//	derived=false   - leave out thumbnails, extracts, labels and sidecars
+//	json=true       - a Listing rather than html links
+func getListHandler(w http.ResponseWriter, r *http.Request, pathTokens []string) {
+	q := r.URL.Query()
+	dir := "/files"
+	if len(pathTokens) > 2 {
+		dir = strings.TrimSuffix("/files/"+strings.Join(pathTokens[2:], "/"), "/")
+	}
+	prefix := dir + "/"
+
+	sortBy := q.Get("sort")
+	if sortBy == "" {
+		sortBy = "name"
+	}
+	column, ok := listSorts[sortBy]
+	if !ok {
+		HandleReturnedStatus(w, http.StatusBadRequest, ErrListSort, "Could not list %s: %v", dir)
+		return
+	}
+	order := "ASC"
+	if q.Get("order") == "desc" {
+		order = "DESC"
+	}
+	limit, offset, err := parsePaging(q, 0)
+	if err != nil {
+		HandleReturnedStatus(w, http.StatusBadRequest, err, "Could not list %s: %v", dir)
+		return
+	}
+
+	where := `path = ?`
+	args := []interface{}{prefix}
+	if q.Get("recursive") == "true" {
+		where = `substr(path, 1, length(?)) = ?`
+		args = append(args, prefix)
+	}
+	if q.Get("derived") == "false" {
+		where += ` AND coalesce(derivedOf, '') = ''`
+	}
+	rows, err := theDB.Query(
+		`SELECT path, name, coalesce(contentSize, 0), coalesce(sha256, ''), coalesce(uploader, ''),
+		        coalesce(created, ''), coalesce(modified, ''), coalesce(derivedOf, '')
+		 FROM filemeta WHERE `+where+` ORDER BY `+column+` `+order+`, path, name`,
+		args...,
+	)
+	if err != nil {
+		HandleError(w, err, "Could not list %s: %v", dir)
+		return
+	}
+	defer rows.Close()
+
+	// Rows are filtered by permission as they are read, so that is where the page is counted
+	user := GetUser(r)
+	readable := make(map[string]bool)
+	listing := Listing{
+		Children: []Node{},
+	}
+	skipped := 0
+	for rows.Next() {
+		var n Node
+		err = rows.Scan(&n.Path, &n.Name, &n.Size, &n.Sha256, &n.Uploader, &n.Created, &n.Modified, &n.DerivedOf)
+		if err != nil {
+			HandleError(w, err, "Could not list %s: %v", dir)
+			return
+		}
+		k := n.Path + OriginalName(n.Name)
+		if _, ok := readable[k]; !ok {
+			readable[k] = CanRead(user, strings.TrimSuffix(n.Path, "/"), n.Name)
+		}
+		if !readable[k] {
+			continue
+		}
+		if skipped < offset {
+			skipped++
+			continue
+		}
+		listing.Children = append(listing.Children, n)
+		if limit > 0 && len(listing.Children) == limit {
+			break
+		}
+	}
+
+	if q.Get("json") == "true" {
+		for i := range listing.Children {
+			n := &listing.Children[i]
+			n.Attributes = getAttrs(user, "."+n.Path, n.Name)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(AsJson(listing)))
+	} else {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<ul>` + "\n"))
+		for _, n := range listing.Children {
+			w.Write([]byte(fmt.Sprintf(
+				`  <li><a href="%s%s">%s%s %s</a> %s %s`+"\n",
+				n.Path, n.Name, n.Path, n.Name, getSizeUnits(n.Size, false), n.Modified, n.Uploader,
+			)))
+		}
+		w.Write([]byte(`</ul>` + "\n"))
+	}
+}
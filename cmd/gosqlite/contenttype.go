@@ -0,0 +1,89 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// Content types by lowercased extension.  config.json can add to or override these
+// with "contentTypes": {".heic": "image/heic"}
+var contentTypes = map[string]string{
+	".txt":  "text/plain; charset=utf-8",
+	".md":   "text/markdown; charset=utf-8",
+	".csv":  "text/csv; charset=utf-8",
+	".tsv":  "text/tab-separated-values; charset=utf-8",
+	".html": "text/html; charset=utf-8",
+	".htm":  "text/html; charset=utf-8",
+	".css":  "text/css; charset=utf-8",
+	".js":   "text/javascript; charset=utf-8",
+	".rego": "text/plain; charset=utf-8",
+	".json": "application/json",
+	".xml":  "application/xml",
+	".yaml": "application/yaml",
+	".yml":  "application/yaml",
+
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".png":  "image/png",
+	".gif":  "image/gif",
+	".webp": "image/webp",
+	".bmp":  "image/bmp",
+	".tif":  "image/tiff",
+	".tiff": "image/tiff",
+	".svg":  "image/svg+xml",
+
+	".mp4":  "video/mp4",
+	".m4v":  "video/x-m4v",
+	".mov":  "video/quicktime",
+	".webm": "video/webm",
+	".mkv":  "video/x-matroska",
+	".avi":  "video/x-msvideo",
+
+	".pdf":  "application/pdf",
+	".doc":  "application/msword",
+	".xls":  "application/vnd.ms-excel",
+	".ppt":  "application/vnd.ms-powerpoint",
+	".docx": "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	".xlsx": "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	".pptx": "application/vnd.openxmlformats-officedocument.presentationml.presentation",
+	".one":  "application/onenote",
+}
+
+// The content type for a name, or "" when the extension is not known
+func contentTypeByName(name string) string {
+	ext := strings.ToLower(path.Ext(name))
+	if ext == "" {
+		return ""
+	}
+	if t, ok := theConfig.ContentTypes[ext]; ok {
+		return t
+	}
+	return contentTypes[ext]
+}
+
+// The extension decides when it is known, as magic bytes cannot tell a docx from a zip.
+// Otherwise the content is sniffed.
+func DetectContentType(fsName string) (string, error) {
+	if t := contentTypeByName(fsName); t != "" {
+		return t, nil
+	}
+	f, err := os.Open(fsName)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	return http.DetectContentType(head[:n]), nil
+}
+
+// The content type without parameters such as charset
+func mediaType(contentType string) string {
+	return strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+}
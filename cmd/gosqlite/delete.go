@@ -0,0 +1,210 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+var ErrDeleteRoot = errors.New("refusing to delete all files")
+
+// Check everything that would be removed, before anything is removed.
+// Removing a policy opens things up, so that takes an admin, like changing one.
+func canDelete(user User, parentDir string, name string, isDir bool) error {
+	for _, sibling := range siblingNames(name) {
+		if IsPermissionFile(sibling) && !IsAdmin(user) {
+			if _, err := os.Stat("." + parentDir + "/" + sibling); err == nil {
+				return ErrAdminRequired
+			}
+		}
+	}
+	if !isDir {
+		if IsPermissionFile(name) && !IsAdmin(user) {
+			return ErrAdminRequired
+		}
+		if !CanWrite(user, parentDir, OriginalName(name)) {
+			return ErrWriteDenied
+		}
+		return nil
+	}
+	return filepath.Walk("."+parentDir+"/"+name, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		p = "/" + filepath.ToSlash(filepath.Clean(p))
+		if info.IsDir() {
+			if !CanWrite(user, p, "") {
+				return ErrWriteDenied
+			}
+			return nil
+		}
+		if IsPermissionFile(info.Name()) && !IsAdmin(user) {
+			return ErrAdminRequired
+		}
+		if !CanWrite(user, path.Dir(p), OriginalName(info.Name())) {
+			return ErrWriteDenied
+		}
+		return nil
+	})
+}
+
+// Remove the search and catalog rows for a file and everything derived from it,
+// or for a whole directory when isDir
+func deleteRows(tx *sql.Tx, parentDir string, name string, isDir bool) error {
+	names := append([]string{name}, siblingNames(name)...)
+	for _, n := range names {
+		_, err := tx.Exec(`DELETE FROM filesearch WHERE path = ? AND name = ?`, parentDir+"/", n)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`DELETE FROM filemeta WHERE path = ? AND name = ?`, parentDir+"/", n)
+		if err != nil {
+			return err
+		}
+	}
+	_, err := tx.Exec(`DELETE FROM filesearch WHERE original_path = ? AND original_name = ?`, parentDir+"/", name)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM fileversion WHERE path = ? AND name = ?`, parentDir+"/", name)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM job WHERE path = ? AND name = ?`, parentDir+"/", name)
+	if err != nil {
+		return err
+	}
+	if isDir {
+		prefix := parentDir + "/" + name + "/"
+		_, err = tx.Exec(`DELETE FROM filesearch WHERE substr(path, 1, length(?)) = ? OR substr(original_path, 1, length(?)) = ?`, prefix, prefix, prefix, prefix)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`DELETE FROM filemeta WHERE substr(path, 1, length(?)) = ?`, prefix, prefix)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`DELETE FROM fileversion WHERE substr(path, 1, length(?)) = ?`, prefix, prefix)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`DELETE FROM job WHERE substr(path, 1, length(?)) = ?`, prefix, prefix)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The blobs of the catalogued files that deleteRows removes
+func deletedHashes(tx *sql.Tx, parentDir string, name string, isDir bool) ([]string, error) {
+	names := append([]string{name}, siblingNames(name)...)
+	where := `path = ? AND name IN (` + strings.TrimSuffix(strings.Repeat("?,", len(names)), ",") + `)`
+	args := []interface{}{parentDir + "/"}
+	for _, n := range names {
+		args = append(args, n)
+	}
+	if isDir {
+		prefix := parentDir + "/" + name + "/"
+		where += ` OR substr(path, 1, length(?)) = ?`
+		args = append(args, prefix, prefix)
+	}
+	return catalogHashes(tx, where, args...)
+}
+
+// DELETE /files/robf/docs/resume.pdf removes the file along with its thumbnail, extract,
+// labels, attributes, permission and previous versions, and their rows in the database.
+// DELETE /files/robf/docs/ removes the whole directory in the same way.
+func deleteFilesHandler(w http.ResponseWriter, r *http.Request, pathTokens []string) {
+	target := path.Clean(r.URL.Path)
+	if target == "/files" {
+		HandleReturnedStatus(w, http.StatusBadRequest, ErrDeleteRoot, "Could not delete %s: %v", r.URL.Path)
+		return
+	}
+	parentDir := path.Dir(target)
+	name := path.Base(target)
+
+	// Attributes may have been posted before the file ever was
+	isDir := false
+	found := false
+	if s, err := os.Stat("." + target); err == nil {
+		isDir = s.IsDir()
+		found = true
+	}
+	for _, sibling := range siblingNames(name) {
+		if _, err := os.Stat("." + parentDir + "/" + sibling); err == nil {
+			found = true
+		}
+	}
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	err := canDelete(GetUser(r), parentDir, name, isDir)
+	if err == ErrWriteDenied || err == ErrAdminRequired {
+		HandleReturnedStatus(w, http.StatusForbidden, err, "Could not delete %s: %v", target)
+		return
+	}
+	if err != nil {
+		HandleError(w, err, "Could not check %s for delete: %v", target)
+		return
+	}
+
+	tx, err := theDB.Begin()
+	if err != nil {
+		HandleError(w, err, "Could not begin delete of %s: %v", target)
+		return
+	}
+	defer tx.Rollback()
+	hashes, err := deletedHashes(tx, parentDir, name, isDir)
+	if err != nil {
+		HandleError(w, err, "Could not find blobs of %s: %v", target)
+		return
+	}
+	err = deleteRows(tx, parentDir, name, isDir)
+	if err != nil {
+		HandleError(w, err, "Could not delete rows for %s: %v", target)
+		return
+	}
+
+	for _, n := range append([]string{name}, siblingNames(name)...) {
+		err = os.RemoveAll("." + parentDir + "/" + n)
+		if err != nil {
+			HandleError(w, err, "Could not delete %s: %v", fmt.Sprintf("%s/%s", parentDir, n))
+			return
+		}
+	}
+
+	// Previous versions go too, for a file or a whole directory
+	hashes = append(hashes, unsharedHashes(versionsDir+target)...)
+	err = os.RemoveAll(versionsDir + target)
+	if err != nil {
+		HandleError(w, err, "Could not delete versions of %s: %v", target)
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		HandleError(w, err, "Could not commit delete of %s: %v", target)
+		return
+	}
+	sweepBlobs(hashes)
+}
+
+func deleteHandler(w http.ResponseWriter, r *http.Request, pathTokens []string) {
+	if len(pathTokens) > 2 && pathTokens[1] == "files" && strings.HasPrefix(r.URL.Path, "/files/") {
+		deleteFilesHandler(w, r, pathTokens)
+		return
+	}
+	if len(pathTokens) > 2 && pathTokens[1] == "upload" {
+		deleteUploadHandler(w, r, pathTokens)
+		return
+	}
+	w.WriteHeader(http.StatusNotImplemented)
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"testing"
+)
+
+// A policy is only removed by an admin, whether on its own or along with its file
+func TestDeletePermission(t *testing.T) {
+	testServer(t)
+	testStatus(t, http.MethodPost, "/files/robf/secret.pdf", testAdmin, "secret", http.StatusOK)
+	testStatus(t, http.MethodPost, "/files/robf/secret.pdf--attributes.json", testAdmin, "{}", http.StatusOK)
+	testStatus(t, http.MethodPost, "/files/robf/secret.pdf--permission.rego", testAdmin, testOwnerPolicy, http.StatusOK)
+
+	testStatus(t, http.MethodDelete, "/files/robf/secret.pdf--permission.rego", testUser, "", http.StatusForbidden)
+	testStatus(t, http.MethodDelete, "/files/robf/secret.pdf", testUser, "", http.StatusForbidden)
+	testStatus(t, http.MethodDelete, "/files/robf/secret.pdf--attributes.json", testUser, "", http.StatusForbidden)
+	_, err := os.Stat("./files/robf/secret.pdf--permission.rego")
+	if err != nil {
+		t.Fatalf("the policy is gone: %v", err)
+	}
+
+	testStatus(t, http.MethodDelete, "/files/robf/secret.pdf--permission.rego", testAdmin, "", http.StatusOK)
+	_, err = os.Stat("./files/robf/secret.pdf--permission.rego")
+	if !os.IsNotExist(err) {
+		t.Fatalf("the policy is still there: %v", err)
+	}
+}
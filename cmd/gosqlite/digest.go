@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+)
+
+var ErrDigestHeader = errors.New("Digest, Content-MD5 or X-Checksum-Sha256 could not be parsed")
+var ErrDigestMismatch = errors.New("content does not match the digest that was sent with it")
+
+// Hashes a request body as it is read, so that what was written can be checked against
+// any of these that the client sent:
+//
+//	Digest: sha-256=X48E9qOokqqrvdts8nOJRJN3OWDUoyWxBf7kbu9DBPE=,md5=XrY7u+Ae7tCTyyK7j1rNww==
+//	Content-MD5: XrY7u+Ae7tCTyyK7j1rNww==
+//	X-Checksum-Sha256: 5f8d7a3b...  (hex)
+//
+// The computed digest is sent back in the same forms, so that clients can confirm it.
+type digestReader struct {
+	r          io.Reader
+	md5        hash.Hash
+	sha256     hash.Hash
+	wantMD5    [][]byte
+	wantSha256 [][]byte
+}
+
+func newDigestReader(r *http.Request, body io.Reader) (*digestReader, error) {
+	d := &digestReader{
+		r:      body,
+		md5:    md5.New(),
+		sha256: sha256.New(),
+	}
+	for _, v := range r.Header.Values("Digest") {
+		for _, instance := range strings.Split(v, ",") {
+			kv := strings.SplitN(strings.TrimSpace(instance), "=", 2)
+			if len(kv) != 2 {
+				return nil, ErrDigestHeader
+			}
+			// Algorithms that we do not know are ignored, as the RFC says
+			switch strings.ToLower(kv[0]) {
+			case "sha-256":
+				b, err := base64.StdEncoding.DecodeString(kv[1])
+				if err != nil || len(b) != sha256.Size {
+					return nil, ErrDigestHeader
+				}
+				d.wantSha256 = append(d.wantSha256, b)
+			case "md5":
+				b, err := base64.StdEncoding.DecodeString(kv[1])
+				if err != nil || len(b) != md5.Size {
+					return nil, ErrDigestHeader
+				}
+				d.wantMD5 = append(d.wantMD5, b)
+			}
+		}
+	}
+	if v := r.Header.Get("Content-MD5"); v != "" {
+		b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(v))
+		if err != nil || len(b) != md5.Size {
+			return nil, ErrDigestHeader
+		}
+		d.wantMD5 = append(d.wantMD5, b)
+	}
+	if v := r.Header.Get("X-Checksum-Sha256"); v != "" {
+		b, err := hex.DecodeString(strings.TrimSpace(v))
+		if err != nil || len(b) != sha256.Size {
+			return nil, ErrDigestHeader
+		}
+		d.wantSha256 = append(d.wantSha256, b)
+	}
+	return d, nil
+}
+
+func (d *digestReader) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	d.md5.Write(p[:n])
+	d.sha256.Write(p[:n])
+	return n, err
+}
+
+// Check what was read against what the client sent, once all of it is read
+func (d *digestReader) verify() error {
+	gotMD5 := d.md5.Sum(nil)
+	gotSha256 := d.sha256.Sum(nil)
+	for _, want := range d.wantMD5 {
+		if !bytes.Equal(want, gotMD5) {
+			return ErrDigestMismatch
+		}
+	}
+	for _, want := range d.wantSha256 {
+		if !bytes.Equal(want, gotSha256) {
+			return ErrDigestMismatch
+		}
+	}
+	return nil
+}
+
+// Send back what was computed, whether or not the client asked for a check
+func (d *digestReader) setHeaders(w http.ResponseWriter) {
+	gotMD5 := d.md5.Sum(nil)
+	gotSha256 := d.sha256.Sum(nil)
+	w.Header().Set("Digest", fmt.Sprintf(
+		"sha-256=%s,md5=%s",
+		base64.StdEncoding.EncodeToString(gotSha256), base64.StdEncoding.EncodeToString(gotMD5),
+	))
+	w.Header().Set("X-Checksum-Sha256", hex.EncodeToString(gotSha256))
+}
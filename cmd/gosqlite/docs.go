@@ -5,34 +5,19 @@ import (
 	"io"
 	"net/http"
 	"os/exec"
-	"strings"
 )
 
 // ie: things that Tika can handle to produce IsTextFile
-func IsDoc(fName string) bool {
-	if strings.HasSuffix(fName, ".doc") {
-		return true
-	}
-	if strings.HasSuffix(fName, ".ppt") {
-		return true
-	}
-	if strings.HasSuffix(fName, ".xls") {
-		return true
-	}
-	if strings.HasSuffix(fName, ".docx") {
-		return true
-	}
-	if strings.HasSuffix(fName, ".pptx") {
-		return true
-	}
-	if strings.HasSuffix(fName, ".xlsx") {
-		return true
-	}
-	if strings.HasSuffix(fName, ".pdf") {
-		return true
-	}
-	// ?? a guess
-	if strings.HasSuffix(fName, ".one") {
+func IsDoc(contentType string) bool {
+	switch mediaType(contentType) {
+	case "application/pdf",
+		"application/msword",
+		"application/vnd.ms-excel",
+		"application/vnd.ms-powerpoint",
+		"application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+		"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+		"application/vnd.openxmlformats-officedocument.presentationml.presentation",
+		"application/onenote":
 		return true
 	}
 	return false
@@ -54,25 +54,10 @@ func videoThumbnail(file string) (io.Reader, error) {
 	return pipeReader, nil
 }
 
-func IsVideo(fName string) bool {
-	if strings.HasSuffix(fName, ".mp4") {
-		return true
-	}
-	return false
+func IsVideo(contentType string) bool {
+	return strings.HasPrefix(mediaType(contentType), "video/")
 }
 
-func IsImage(fName string) bool {
-	if strings.HasSuffix(fName, ".jpg") {
-		return true
-	}
-	if strings.HasSuffix(fName, ".jpeg") {
-		return true
-	}
-	if strings.HasSuffix(fName, ".png") {
-		return true
-	}
-	if strings.HasSuffix(fName, ".gif") {
-		return true
-	}
-	return false
+func IsImage(contentType string) bool {
+	return strings.HasPrefix(mediaType(contentType), "image/")
 }
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+var ErrInstallEntry = errors.New("entry would land outside of the install directory")
+var ErrInstallLink = errors.New("links are not installed")
+var ErrInstallType = errors.New("only files and directories are installed")
+
+// While installing into /files/app/v1, the archive is unpacked into a sibling
+// such as /files/app/.v1.installing-123 and then swapped in, so that a failed install
+// leaves the previous version intact.
+const installingInfix = ".installing-"
+const previousInfix = ".previous-"
+
+// Installs and uploads in progress are hidden from listings and archives
+func isTempName(name string) bool {
+	return strings.HasPrefix(name, ".") &&
+		(strings.Contains(name, installingInfix) || strings.Contains(name, previousInfix) ||
+			strings.Contains(name, uploadingInfix))
+}
+
+// Entries are relative to the install directory, such as ./index.html or index.html.
+// Anything that could land outside of the install directory is refused.
+// Returns "" for the install directory itself, and whether the name began with ./
+func installEntryPath(name string) (string, bool, error) {
+	if strings.HasPrefix(name, "/") || strings.Contains(name, "\\") {
+		return "", false, ErrInstallEntry
+	}
+	for _, s := range strings.Split(name, "/") {
+		if s == ".." {
+			return "", false, ErrInstallEntry
+		}
+	}
+	dotted := name == "." || strings.HasPrefix(name, "./")
+	rel := path.Clean(name)
+	if rel == "." {
+		return "", dotted, nil
+	}
+	return rel, dotted, nil
+}
+
+// Unpack the archive into stage.  Nothing is checked against policies yet,
+// as where entries land depends upon all of them.  Quotas are, as an archive can unpack
+// to far more than its size, unless quota is nil.
+// Returns the directory to install, which is a single top directory such as build/
+// when the archive has nothing else, and its entries were not named like ./index.html
+func stageInstall(w http.ResponseWriter, r *http.Request, stream io.Reader, target string, stage string, quota *quotaReader) (string, error) {
+	a, cleanup, err := openArchive(stream, r.Header.Get("Content-Type"))
+	defer cleanup()
+	if err != nil {
+		return "", HandleReturnedStatus(w, http.StatusBadRequest, err, "Could not open archive for %s: %v", target)
+	}
+	anyDotted := false
+	for {
+		entry, err := a.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", HandleReturnedStatus(w, http.StatusBadRequest, err, "Could not read archive for %s: %v", target)
+		}
+		rel, dotted, err := installEntryPath(entry.name)
+		if err != nil {
+			return "", HandleReturnedStatus(w, http.StatusBadRequest, err, "Could not install %s: %v", entry.name)
+		}
+		anyDotted = anyDotted || dotted
+		if rel == "" {
+			continue
+		}
+		fsName := filepath.Join(stage, filepath.FromSlash(rel))
+
+		switch entry.kind {
+		case entryDir:
+			err = os.MkdirAll(fsName, 0777)
+			if err != nil {
+				return "", HandleReturnedError(w, err, "Could not create directory %s: %v", rel)
+			}
+			continue
+		case entryFile:
+		case entryLink:
+			return "", HandleReturnedStatus(w, http.StatusBadRequest, ErrInstallLink, "Could not install %s: %v", entry.name)
+		case entrySkip:
+			continue
+		default:
+			return "", HandleReturnedStatus(w, http.StatusBadRequest, ErrInstallType, "Could not install %s: %v", entry.name)
+		}
+
+		log.Printf("writing: %s into %s", rel, target)
+		err = os.MkdirAll(filepath.Dir(fsName), 0777)
+		if err != nil {
+			return "", HandleReturnedError(w, err, "Could not create path for %s: %v", rel)
+		}
+		f, err := os.Create(fsName)
+		if err != nil {
+			return "", HandleReturnedError(w, err, "Could not create file %s: %v", rel)
+		}
+		body := entry.body
+		if quota != nil {
+			// Every entry counts against what is left of the same quota
+			quota.r = entry.body
+			body = quota
+		}
+		sz, err := io.Copy(f, body)
+		f.Close()
+		if err == ErrQuotaExceeded {
+			return "", HandleReturnedStatus(w, http.StatusInsufficientStorage, err, "Could not install into %s: %v", target)
+		}
+		if err != nil {
+			return "", HandleReturnedError(w, err, "Could not write to file (%d bytes written) %s: %v", sz, rel)
+		}
+	}
+
+	root := stage
+	entries, err := ioutil.ReadDir(stage)
+	if err != nil {
+		return "", HandleReturnedError(w, err, "Could not read staged install of %s: %v", target)
+	}
+	if !anyDotted && len(entries) == 1 && entries[0].IsDir() {
+		root = filepath.Join(stage, entries[0].Name())
+	}
+	return root, nil
+}
+
+// Check every staged file against the policy where it will be installed
+func authorizeInstall(w http.ResponseWriter, user User, target string, root string) error {
+	return filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return HandleReturnedError(w, err, "Could not walk staged install of %s: %v", target)
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return HandleReturnedError(w, err, "Could not walk staged install of %s: %v", target)
+		}
+		dir := path.Dir(target + "/" + filepath.ToSlash(rel))
+		name := info.Name()
+		if IsPermissionFile(name) {
+			// Policies are code, so they are checked like any other permission change
+			b, err := ioutil.ReadFile(p)
+			if err != nil {
+				return HandleReturnedError(w, err, "Could not read %s: %v", rel)
+			}
+			status, err := checkPermission(user, b)
+			if err != nil {
+				return HandleReturnedStatus(w, status, err, "Could not install %s: %v", dir+"/"+name)
+			}
+		} else if !CanWrite(user, dir, name) {
+			return HandleReturnedStatus(w, http.StatusForbidden, ErrWriteDenied, "Could not install %s: %v", dir+"/"+name)
+		}
+		return nil
+	})
+}
+
+// The install replaces everything under target, so that is what counts against quotas,
+// including the quota of target itself when it is a top directory such as /files/app.
+// Returns nil when no quota applies.
+func installQuota(w http.ResponseWriter, user User, target string) (*quotaReader, error) {
+	remaining, limited, err := quotaRemaining(user, target, target, "")
+	if err != nil {
+		return nil, HandleReturnedError(w, err, "Could not check quota for %s: %v", target)
+	}
+	if !limited {
+		return nil, nil
+	}
+	return &quotaReader{remaining: remaining}, nil
+}
+
+// Everything in the tree that an install replaced is kept as the previous version of
+// each file, as it would be if the files were uploaded over one at a time
+func keepInstallVersions(target string, previous string) {
+	filepath.Walk(previous, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		name := info.Name()
+		if OriginalName(name) != name || IsPermissionFile(name) || isTempName(name) {
+			return nil
+		}
+		rel, err := filepath.Rel(previous, filepath.Dir(p))
+		if err != nil {
+			return nil
+		}
+		parentDir := path.Clean(target + "/" + filepath.ToSlash(rel))
+		err = preserveVersionOf(filepath.Dir(p), parentDir, name)
+		if err != nil {
+			log.Printf("ERR could not keep previous version of %s/%s: %v", parentDir, name, err)
+		}
+		return nil
+	})
+}
+
+// Swap root in for target, and clear out whatever was catalogued about the previous install.
+// If anything fails, the previous install is put back along with its rows.
+func swapInstall(target string, root string) error {
+	fsTarget := "." + target
+	prefix := target + "/"
+	tx, err := theDB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	hashes, err := catalogHashes(tx, `substr(path, 1, length(?)) = ?`, prefix, prefix)
+	if err != nil {
+		return err
+	}
+	for _, table := range []string{"filesearch", "filemeta", "job"} {
+		_, err = tx.Exec(`DELETE FROM `+table+` WHERE substr(path, 1, length(?)) = ?`, prefix, prefix)
+		if err != nil {
+			return err
+		}
+	}
+
+	previous := ""
+	if _, err := os.Stat(fsTarget); err == nil {
+		previous, err = ioutil.TempDir(filepath.Dir(fsTarget), "."+path.Base(target)+previousInfix)
+		if err == nil {
+			os.Remove(previous)
+			err = os.Rename(fsTarget, previous)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	err = os.Rename(root, fsTarget)
+	if err != nil {
+		if previous != "" {
+			os.Rename(previous, fsTarget)
+		}
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		os.Rename(fsTarget, root)
+		if previous != "" {
+			os.Rename(previous, fsTarget)
+		}
+		return err
+	}
+
+	if previous != "" {
+		keepInstallVersions(target, previous)
+		os.RemoveAll(previous)
+	}
+	sweepBlobs(hashes)
+	return nil
+}
+
+// Install an archive into /files/parentDir/name, replacing whatever was there.
+// Files are catalogued and derived only once all of them are in place.
+func installHandler(w http.ResponseWriter, r *http.Request, parentDir string, name string) error {
+	target := parentDir + "/" + name
+	user := GetUser(r)
+	// Refuse up front, rather than after reading half of the archive.
+	// Every entry is still checked, as it may have its own policy.
+	if !CanWrite(user, target, "") {
+		return HandleReturnedStatus(w, http.StatusForbidden, ErrWriteDenied, "Could not install into %s: %v", target)
+	}
+	// What is there now is removed, so that is checked like a delete
+	if s, err := os.Stat("." + target); err == nil {
+		err = canDelete(user, parentDir, name, s.IsDir())
+		if err == ErrWriteDenied || err == ErrAdminRequired {
+			return HandleReturnedStatus(w, http.StatusForbidden, err, "Could not install over %s: %v", target)
+		}
+		if err != nil {
+			return HandleReturnedError(w, err, "Could not check %s for install: %v", target)
+		}
+	}
+
+	err := os.MkdirAll("."+parentDir, 0777)
+	if err != nil {
+		return HandleReturnedError(w, err, "Could not create path for %s: %v", target)
+	}
+	stage, err := ioutil.TempDir("."+parentDir, "."+name+installingInfix)
+	if err == nil {
+		// It will become the target, so it should not stay private like a temp dir
+		err = os.Chmod(stage, 0755)
+	}
+	if err != nil {
+		return HandleReturnedError(w, err, "Could not stage install of %s: %v", target)
+	}
+	// Whatever is left of stage is removed, whether the install worked or not
+	defer os.RemoveAll(stage)
+	body, err := newDigestReader(r, r.Body)
+	if err != nil {
+		return HandleReturnedStatus(w, http.StatusBadRequest, err, "Could not install into %s: %v", target)
+	}
+	quota, err := installQuota(w, user, target)
+	if err != nil {
+		return err
+	}
+	root, err := stageInstall(w, r, body, target, stage, quota)
+	if err != nil {
+		return err
+	}
+	// An archive can end before the body does, such as the padding of a tar
+	_, err = io.Copy(ioutil.Discard, body)
+	if err != nil {
+		return HandleReturnedError(w, err, "Could not read archive for %s: %v", target)
+	}
+	err = verifyDigest(w, body)
+	if err != nil {
+		return HandleReturnedStatus(w, http.StatusBadRequest, err, "Could not install into %s: %v", target)
+	}
+	err = authorizeInstall(w, user, target, root)
+	if err != nil {
+		return err
+	}
+	err = swapInstall(target, root)
+	if err != nil {
+		return HandleReturnedError(w, err, "Could not swap in install of %s: %v", target)
+	}
+
+	return filepath.Walk("."+target, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return HandleReturnedError(w, err, "Could not walk install of %s: %v", target)
+		}
+		if info.IsDir() {
+			return nil
+		}
+		dir := "/" + filepath.ToSlash(filepath.Dir(filepath.Clean(p)))
+		fName := info.Name()
+		if IsPermissionFile(fName) {
+			b, err := ioutil.ReadFile(p)
+			if err == nil {
+				err = recordPermission(user, dir, fName, b)
+			}
+			if err != nil {
+				return HandleReturnedError(w, err, "Could not version %s: %v", fmt.Sprintf("%s/%s", dir, fName))
+			}
+		}
+		// An archive exported with its derived files brings them along.  They are catalogued
+		// as belonging to their original, and made again from it, rather than derived from.
+		if original := OriginalName(fName); original != fName {
+			return postWrittenFile(w, r, "files", dir, fName, dir, original, false, false, 0, info.Size())
+		}
+		return postWrittenFile(w, r, "files", dir, fName, dir, fName, true, true, 0, info.Size())
+	})
+}
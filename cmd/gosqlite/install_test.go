@@ -0,0 +1,89 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestInstallEntryPath(t *testing.T) {
+	tests := []struct {
+		name   string
+		rel    string
+		dotted bool
+		err    bool
+	}{
+		{"index.html", "index.html", false, false},
+		{"./index.html", "index.html", true, false},
+		{"build/static/app.js", "build/static/app.js", false, false},
+		{"build/", "build", false, false},
+		{"a/./b", "a/b", false, false},
+		{"a//b", "a/b", false, false},
+		{".", "", true, false},
+		{"./", "", true, false},
+		{".hidden", ".hidden", false, false},
+		{"..a/b..", "..a/b..", false, false},
+
+		{"..", "", false, true},
+		{"../x", "", false, true},
+		{"./../x", "", false, true},
+		{"a/../../x", "", false, true},
+		{"a/..", "", false, true},
+		{"a/b/../c", "", false, true},
+		{"/etc/passwd", "", false, true},
+		{"/", "", false, true},
+		{`a\b`, "", false, true},
+		{`..\x`, "", false, true},
+		{`C:\x`, "", false, true},
+	}
+	for _, test := range tests {
+		rel, dotted, err := installEntryPath(test.name)
+		if test.err {
+			if err != ErrInstallEntry {
+				t.Errorf("installEntryPath(%q) = %q, %v, want %v", test.name, rel, err, ErrInstallEntry)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("installEntryPath(%q) failed: %v", test.name, err)
+			continue
+		}
+		if rel != test.rel || dotted != test.dotted {
+			t.Errorf("installEntryPath(%q) = %q, %v, want %q, %v", test.name, rel, dotted, test.rel, test.dotted)
+		}
+	}
+}
+
+// A tar of name and content pairs
+func testTar(t *testing.T, files ...string) string {
+	var b bytes.Buffer
+	tw := tar.NewWriter(&b)
+	for i := 0; i+1 < len(files); i += 2 {
+		err := tw.WriteHeader(&tar.Header{Name: files[i], Mode: 0644, Size: int64(len(files[i+1]))})
+		if err == nil {
+			_, err = tw.Write([]byte(files[i+1]))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := tw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b.String()
+}
+
+// Installing a top directory counts against the quota of that directory
+func TestInstallQuota(t *testing.T) {
+	testServer(t)
+	theConfig.Quotas = map[string]string{"app": "100B"}
+	big := testTar(t, "index.html", strings.Repeat("x", 200))
+	small := testTar(t, "index.html", strings.Repeat("x", 50))
+
+	testStatus(t, http.MethodPost, "/files/app?install=true", testAdmin, big, http.StatusInsufficientStorage)
+	testStatus(t, http.MethodPost, "/files/app?install=true", testAdmin, small, http.StatusOK)
+	testStatus(t, http.MethodPost, "/files/app/v1?install=true", testAdmin, big, http.StatusInsufficientStorage)
+}
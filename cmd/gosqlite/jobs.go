@@ -0,0 +1,290 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Thumbnails, extracts and labels are made in the background, so that an upload
+// returns as soon as its content is stored.  Jobs are kept in the job table so that
+// they survive a restart, and a failed job is tried again later, up to JOB_ATTEMPTS times.
+//
+//	queued  - waiting for a worker, or for its next attempt after a failure
+//	running - a worker has it
+//	done    - everything was derived
+//	failed  - it failed on every attempt, and error says why
+type Job struct {
+	Id       int64  `json:"id"`
+	Path     string `json:"path"`
+	Name     string `json:"name"`
+	State    string `json:"state"`
+	Attempts int    `json:"attempts"`
+	Error    string `json:"error,omitempty"`
+	Uploader string `json:"uploader,omitempty"`
+	Created  string `json:"created"`
+	Updated  string `json:"updated"`
+}
+
+var ErrJobGone = errors.New("the file was removed while deriving from it")
+var ErrJobMoved = errors.New("the file was moved while deriving from it")
+
+var jobAttempts int
+
+// Wakes a worker when a job is queued.  Retries are found by polling.
+var jobsWake = make(chan struct{}, 1)
+
+// Only one worker at a time may claim a job
+var jobsClaim sync.Mutex
+
+const jobPoll = 5 * time.Second
+
+// Is there anything to derive from this kind of content
+func isDerivable(contentType string) bool {
+	return IsDoc(contentType) || IsVideo(contentType) || IsImage(contentType)
+}
+
+func jobTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// Queue derivation of parentDir/name, replacing any job for it that has not started yet
+func enqueueDerive(parentDir string, name string, uploader string) error {
+	now := jobTime(time.Now())
+	tx, err := theDB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(
+		`DELETE FROM job WHERE path = ? AND name = ? AND state != 'running'`,
+		parentDir+"/", name,
+	)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(
+		`INSERT INTO job (path, name, state, attempts, error, uploader, created, updated, due)
+		 VALUES (?, ?, 'queued', 0, '', ?, ?, ?, ?)`,
+		parentDir+"/", name, uploader, now, now, now,
+	)
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	select {
+	case jobsWake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Take the next job that is due, or nil if there is none
+func claimJob() (*Job, error) {
+	jobsClaim.Lock()
+	defer jobsClaim.Unlock()
+	now := jobTime(time.Now())
+	var j Job
+	err := theDB.QueryRow(
+		`SELECT id, path, name, attempts, uploader, created FROM job
+		 WHERE state = 'queued' AND due <= ? ORDER BY due, id LIMIT 1`,
+		now,
+	).Scan(&j.Id, &j.Path, &j.Name, &j.Attempts, &j.Uploader, &j.Created)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	j.State = "running"
+	j.Attempts++
+	_, err = theDB.Exec(
+		`UPDATE job SET state = ?, attempts = ?, updated = ? WHERE id = ?`,
+		j.State, j.Attempts, now, j.Id,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &j, nil
+}
+
+// Derive everything from the file as it is now.  A file that has gone away has nothing to derive.
+func runJob(j *Job) error {
+	parentDir := strings.TrimSuffix(j.Path, "/")
+	if _, err := os.Stat("." + parentDir + "/" + j.Name); os.IsNotExist(err) {
+		return nil
+	}
+	_, contentType := catalogServing(parentDir, j.Name)
+	if contentType == "" {
+		var err error
+		contentType, err = DetectContentType("." + parentDir + "/" + j.Name)
+		if err != nil {
+			return err
+		}
+	}
+	err := deriveFile(contentType, parentDir, j.Name, j.Uploader, func() error { return jobCurrent(j) })
+	if err != nil {
+		// Whatever failed was likely the file going away
+		switch jobCurrent(j) {
+		case ErrJobGone:
+			return nil
+		case ErrJobMoved:
+			// It is tried again at its new path
+			return ErrJobMoved
+		}
+	}
+	return err
+}
+
+// Is the job still wanted.  Its row goes away or moves along with its file, when that is deleted,
+// moved or installed over, and then nothing derived may be written at the old path.
+func jobCurrent(j *Job) error {
+	var p, name string
+	err := theDB.QueryRow(`SELECT path, name FROM job WHERE id = ?`, j.Id).Scan(&p, &name)
+	if err == sql.ErrNoRows {
+		return ErrJobGone
+	}
+	if err != nil {
+		return err
+	}
+	if p != j.Path || name != j.Name {
+		return ErrJobMoved
+	}
+	if _, err := os.Stat("." + j.Path + j.Name); os.IsNotExist(err) {
+		return ErrJobGone
+	}
+	return nil
+}
+
+// Record how a job went.  Failures wait longer before each attempt.
+func finishJob(j *Job, jobErr error) {
+	now := time.Now()
+	state, message, due := "done", "", now
+	if jobErr != nil {
+		message = jobErr.Error()
+		if j.Attempts < jobAttempts {
+			state = "queued"
+			due = now.Add(time.Duration(j.Attempts*j.Attempts) * 30 * time.Second)
+		} else {
+			state = "failed"
+		}
+		log.Printf("ERR job %d for %s%s attempt %d: %v", j.Id, j.Path, j.Name, j.Attempts, jobErr)
+	}
+	_, err := theDB.Exec(
+		`UPDATE job SET state = ?, error = ?, updated = ?, due = ? WHERE id = ?`,
+		state, message, jobTime(now), jobTime(due), j.Id,
+	)
+	if err != nil {
+		log.Printf("ERR could not record job %d: %v", j.Id, err)
+	}
+}
+
+func jobWorker() {
+	poll := time.NewTicker(jobPoll)
+	defer poll.Stop()
+	for {
+		for {
+			j, err := claimJob()
+			if err != nil {
+				log.Printf("ERR could not claim a job: %v", err)
+				break
+			}
+			if j == nil {
+				break
+			}
+			finishJob(j, runJob(j))
+		}
+		select {
+		case <-jobsWake:
+		case <-poll.C:
+		}
+	}
+}
+
+// Start the workers, after putting back jobs that were running when the server stopped
+func jobsSetup() {
+	workers, err := strconv.Atoi(Getenv("JOB_WORKERS", "2"))
+	if err != nil || workers < 1 {
+		workers = 1
+	}
+	jobAttempts, err = strconv.Atoi(Getenv("JOB_ATTEMPTS", "3"))
+	if err != nil || jobAttempts < 1 {
+		jobAttempts = 1
+	}
+	_, err = theDB.Exec(`UPDATE job SET state = 'queued' WHERE state = 'running'`)
+	CheckErr(err, "Could not requeue jobs")
+	for i := 0; i < workers; i++ {
+		go jobWorker()
+	}
+}
+
+// GET /jobs/robf/docs/resume.pdf shows how deriving from a file is going,
+// and GET /jobs/robf/docs/ shows it for everything under a directory.
+// state=failed shows only jobs in that state, and json=true returns them as json.
+func getJobsHandler(w http.ResponseWriter, r *http.Request, pathTokens []string) {
+	q := r.URL.Query()
+	target := "/files/" + strings.Join(pathTokens[2:], "/")
+	where := `path = ? AND name = ?`
+	args := []interface{}{}
+	if strings.HasSuffix(target, "/") {
+		where = `substr(path, 1, length(?)) = ?`
+		args = append(args, target, target)
+	} else {
+		i := strings.LastIndex(target, "/")
+		args = append(args, target[:i+1], target[i+1:])
+	}
+	if state := q.Get("state"); state != "" {
+		where += ` AND state = ?`
+		args = append(args, state)
+	}
+	rows, err := theDB.Query(
+		`SELECT id, path, name, state, attempts, error, uploader, created, updated
+		 FROM job WHERE `+where+` ORDER BY id`,
+		args...,
+	)
+	if err != nil {
+		HandleError(w, err, "Could not list jobs for %s: %v", target)
+		return
+	}
+	defer rows.Close()
+
+	user := GetUser(r)
+	jobs := []Job{}
+	for rows.Next() {
+		var j Job
+		err = rows.Scan(&j.Id, &j.Path, &j.Name, &j.State, &j.Attempts, &j.Error, &j.Uploader, &j.Created, &j.Updated)
+		if err != nil {
+			HandleError(w, err, "Could not list jobs for %s: %v", target)
+			return
+		}
+		if !CanRead(user, strings.TrimSuffix(j.Path, "/"), j.Name) {
+			continue
+		}
+		jobs = append(jobs, j)
+	}
+
+	if q.Get("json") == "true" {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(AsJson(jobs)))
+	} else {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<ul>` + "\n"))
+		for _, j := range jobs {
+			w.Write([]byte(fmt.Sprintf(
+				`  <li><a href="%s%s">%s%s</a> %s (attempt %d) %s %s`+"\n",
+				j.Path, j.Name, j.Path, j.Name, j.State, j.Attempts, j.Updated, j.Error,
+			)))
+		}
+		w.Write([]byte(`</ul>` + "\n"))
+	}
+}
@@ -2,13 +2,16 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"sort"
+	"strconv"
 	"strings"
 )
 
@@ -19,11 +22,58 @@ type Node struct {
 	IsDir      bool                   `json:"isDir"`
 	Context    string                 `json:"context,omitempty"`
 	Size       int64                  `json:"size,omitempty"`
+	Sha256     string                 `json:"sha256,omitempty"`
+	Uploader   string                 `json:"uploader,omitempty"`
+	Created    string                 `json:"created,omitempty"`
+	Modified   string                 `json:"modified,omitempty"`
+	DerivedOf  string                 `json:"derivedOf,omitempty"`
+	Part       int                    `json:"part,omitempty"`
+	Score      float64                `json:"score,omitempty"`
+	Hits       int                    `json:"hits,omitempty"`
+	Snippets   []Snippet              `json:"snippets,omitempty"`
+	Parts      string                 `json:"parts,omitempty"`
+	Location   string                 `json:"location,omitempty"`
+}
+
+// A part of a file that matched a search
+type Snippet struct {
+	Part     int     `json:"part"`
+	Score    float64 `json:"score,omitempty"`
+	Location string  `json:"location,omitempty"`
+	Context  string  `json:"context"`
+}
+
+// Where a page is in the whole of a listing, with links to the pages around it
+type Paging struct {
+	Total  int    `json:"total"`
+	Offset int    `json:"offset"`
+	Limit  int    `json:"limit,omitempty"`
+	Prev   string `json:"prev,omitempty"`
+	Next   string `json:"next,omitempty"`
 }
 
 type Listing struct {
 	Attributes map[string]interface{} `json:"attributes,omitempty"`
 	Children   []Node                 `json:"children"`
+	Paging     *Paging                `json:"paging,omitempty"`
+}
+
+var ErrPaging = errors.New("limit and offset must be non-negative integers")
+
+// limit and offset, where limit=0 means everything
+func parsePaging(q url.Values, defaultLimit int) (int, int, error) {
+	limit, offset := defaultLimit, 0
+	var err error
+	if v := q.Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+	}
+	if v := q.Get("offset"); v != "" && err == nil {
+		offset, err = strconv.Atoi(v)
+	}
+	if err != nil || limit < 0 || offset < 0 {
+		return 0, 0, ErrPaging
+	}
+	return limit, offset, nil
 }
 
 // Use the same format as the http.FileServer when given a directory
@@ -72,7 +122,10 @@ func getAttrsPermission(claims interface{}, fsPath string, fName string, initial
 		} else {
 			calculation, err := CalculateRego(claims, string(jf))
 			if err != nil {
+				// A broken policy must not open things up, so fail closed
 				log.Printf("Failed to parse %s!: %v", attrFileName, err)
+				initial["Read"] = false
+				initial["Write"] = false
 			}
 			for k, v := range calculation {
 				initial[k] = v
@@ -128,6 +181,15 @@ func getSizeUnits(size int64, isDir bool) string {
 	return sz
 }
 
+// A directory is governed by its own permission.rego, rather than its parent's
+func canReadEntry(user User, fsPath string, entry os.FileInfo) bool {
+	parentDir := fsPath[1:]
+	if entry.IsDir() {
+		return CanRead(user, parentDir+entry.Name(), "")
+	}
+	return CanRead(user, parentDir, entry.Name())
+}
+
 func dirHandler(w http.ResponseWriter, r *http.Request, fsPath string) {
 	user := GetUser(r)
 	// Get directory names
@@ -140,6 +202,18 @@ func dirHandler(w http.ResponseWriter, r *http.Request, fsPath string) {
 		return names[i].Name() < names[j].Name()
 	})
 
+	// Leave out anything that the user cannot read
+	readable := names[:0]
+	for _, name := range names {
+		if isTempName(name.Name()) {
+			continue
+		}
+		if canReadEntry(user, fsPath, name) {
+			readable = append(readable, name)
+		}
+	}
+	names = readable
+
 	q := r.URL.Query()
 	inJson := q.Get("json") == "true"
 	if inJson {
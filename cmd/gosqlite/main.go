@@ -7,6 +7,7 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"path"
 	"strings"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -37,16 +38,31 @@ func Getenv(k string, defaultValue string) string {
 	return v
 }
 
-// ie: things that FTS5 can handle directly
-func IsTextFile(fName string) bool {
-	if strings.HasSuffix(fName, ".txt") {
-		return true
-	}
-	if strings.HasSuffix(fName, ".json") {
-		return true
+// Prose and data that are worth searching.  Code such as scripts and stylesheets is text too,
+// but an installed app would fill the index with its bundles.  config.json can replace these
+// with "indexedTypes": ["text/plain", "text/x-go"]
+var indexedTypes = []string{
+	"text/plain",
+	"text/markdown",
+	"text/csv",
+	"text/tab-separated-values",
+	"text/html",
+	"application/json",
+	"application/xml",
+	"application/yaml",
+}
+
+// ie: things that FTS5 can handle directly, and that we index
+func IsTextFile(contentType string) bool {
+	t := mediaType(contentType)
+	types := indexedTypes
+	if theConfig.IndexedTypes != nil {
+		types = theConfig.IndexedTypes
 	}
-	if strings.HasSuffix(fName, ".html") {
-		return true
+	for _, indexed := range types {
+		if t == indexed {
+			return true
+		}
 	}
 	return false
 }
@@ -61,10 +77,52 @@ func AsJson(v interface{}) string {
 }
 
 func postHandler(w http.ResponseWriter, r *http.Request, pathTokens []string) {
-	if len(pathTokens) > 2 && pathTokens[1] == "files" {
+	// files is the same as append followed by eof
+	if len(pathTokens) > 2 && (pathTokens[1] == "files" || pathTokens[1] == "append" || pathTokens[1] == "eof") {
 		postFilesHandler(w, r, pathTokens)
 		return
 	}
+	if len(pathTokens) > 2 && pathTokens[1] == "meta" {
+		postMetaHandler(w, r, pathTokens)
+		return
+	}
+	if len(pathTokens) > 2 && pathTokens[1] == "permission" {
+		postPermissionHandler(w, r, pathTokens)
+		return
+	}
+	if len(pathTokens) > 2 && pathTokens[1] == "move" {
+		postMoveHandler(w, r, pathTokens)
+		return
+	}
+	if len(pathTokens) > 2 && pathTokens[1] == "upload" {
+		postUploadHandler(w, r, pathTokens)
+		return
+	}
+	w.WriteHeader(http.StatusNotImplemented)
+}
+
+func putHandler(w http.ResponseWriter, r *http.Request, pathTokens []string) {
+	if len(pathTokens) > 2 && pathTokens[1] == "upload" {
+		putUploadHandler(w, r, pathTokens)
+		return
+	}
+	w.WriteHeader(http.StatusNotImplemented)
+}
+
+// HEAD is answered like GET, without the body, except for upload sessions
+func headHandler(w http.ResponseWriter, r *http.Request, pathTokens []string) {
+	if len(pathTokens) > 2 && pathTokens[1] == "upload" {
+		headUploadHandler(w, r, pathTokens)
+		return
+	}
+	getHandler(w, r, pathTokens)
+}
+
+func patchHandler(w http.ResponseWriter, r *http.Request, pathTokens []string) {
+	if len(pathTokens) > 2 && pathTokens[1] == "meta" {
+		postMetaHandler(w, r, pathTokens)
+		return
+	}
 	w.WriteHeader(http.StatusNotImplemented)
 }
 
@@ -108,6 +166,14 @@ func getHandler(w http.ResponseWriter, r *http.Request, pathTokens []string) {
 				http.Redirect(w, r, r.URL.Path+"/"+q, http.StatusMovedPermanently)
 				return
 			}
+			if !CanRead(user, r.URL.Path, "") {
+				HandleReturnedStatus(w, http.StatusForbidden, ErrReadDenied, "Could not read %s: %v", r.URL.Path)
+				return
+			}
+			if r.URL.Query().Get("archive") != "" {
+				getArchiveHandler(w, r, "."+r.URL.Path)
+				return
+			}
 			sIdx, _ := os.Stat("." + r.URL.Path + "index.html")
 			if sIdx != nil && !sIdx.IsDir() {
 				// Rather than redirect?
@@ -119,18 +185,72 @@ func getHandler(w http.ResponseWriter, r *http.Request, pathTokens []string) {
 			}
 		}
 		// otherwise, just serve a file
-		if strings.HasSuffix(r.URL.Path, ".css") {
-			w.Header().Set("Content-Type", "text/css")
+		parentDir, name := path.Dir(r.URL.Path), path.Base(r.URL.Path)
+		if !CanRead(user, parentDir, name) {
+			HandleReturnedStatus(w, http.StatusForbidden, ErrReadDenied, "Could not read %s: %v", r.URL.Path)
+			return
+		}
+		if r.URL.Query().Get("versions") == "true" {
+			getVersionsHandler(w, r, parentDir, name)
+			return
 		}
-		if strings.HasSuffix(r.URL.Path, ".js") {
-			w.Header().Set("Content-Type", "text/javascript")
+		if version := r.URL.Query().Get("version"); version != "" {
+			fName, err := versionFile(parentDir, name, version)
+			if err == ErrNoVersion {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				HandleError(w, err, "Could not find version %s of %s: %v", version, r.URL.Path)
+				return
+			}
+			if fName != "" {
+				http.ServeFile(w, r, fName)
+				return
+			}
+		}
+		hash, contentType := catalogServing(parentDir, name)
+		if contentType == "" {
+			contentType = contentTypeByName(name)
+		}
+		if contentType != "" {
+			w.Header().Set("Content-Type", contentType)
 		}
-		if strings.HasSuffix(r.URL.Path, ".md") {
-			w.Header().Set("Content-Type", "text/markdown")
+		if hash != "" {
+			w.Header().Set("ETag", `"`+hash+`"`)
+		}
+		// A search hit links to where it is in the file
+		if r.URL.Query().Get("offset") != "" || r.URL.Query().Get("length") != "" {
+			byteRange, err := textRange(r.URL.Query())
+			if err != nil {
+				HandleReturnedStatus(w, http.StatusBadRequest, err, "Could not read %s: %v", r.URL.Path)
+				return
+			}
+			r.Header.Set("Range", byteRange)
 		}
 		theFS.ServeHTTP(w, r)
 		return
 	}
+	if strings.HasPrefix(r.URL.Path, "/meta/") && len(pathTokens) > 2 {
+		getMetaHandler(w, r, pathTokens)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/permission/") {
+		getPermissionHandler(w, r, pathTokens)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/quota/") {
+		getQuotaHandler(w, r, pathTokens)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/jobs/") {
+		getJobsHandler(w, r, pathTokens)
+		return
+	}
+	if r.URL.Path == "/list" || strings.HasPrefix(r.URL.Path, "/list/") {
+		getListHandler(w, r, pathTokens)
+		return
+	}
 	// try search handler
 	if r.URL.Path == "/search" || strings.HasPrefix(r.URL.Path, "/search/") {
 		getSearchHandler(w, r, pathTokens)
@@ -141,16 +261,18 @@ func getHandler(w http.ResponseWriter, r *http.Request, pathTokens []string) {
 }
 
 func HandleError(w http.ResponseWriter, err error, mask string, args ...interface{}) {
-	msg := fmt.Sprintf(mask, append(args, err.Error())...)
-	log.Printf("ERR %s", msg)
-	w.WriteHeader(http.StatusInternalServerError)
-	w.Write([]byte(msg))
+	HandleReturnedStatus(w, http.StatusInternalServerError, err, mask, args...)
 }
 
 func HandleReturnedError(w http.ResponseWriter, err error, mask string, args ...interface{}) error {
+	return HandleReturnedStatus(w, http.StatusInternalServerError, err, mask, args...)
+}
+
+// Not every failure is the server's fault, such as permission denied
+func HandleReturnedStatus(w http.ResponseWriter, status int, err error, mask string, args ...interface{}) error {
 	msg := fmt.Sprintf(mask, append(args, err.Error())...)
 	log.Printf("ERR %s", msg)
-	w.WriteHeader(http.StatusInternalServerError)
+	w.WriteHeader(status)
 	w.Write([]byte(msg))
 	return fmt.Errorf("%v", msg)
 }
@@ -165,6 +287,18 @@ func rootRouter(w http.ResponseWriter, r *http.Request) {
 	case http.MethodPost:
 		postHandler(w, r, pathTokens)
 		return
+	case http.MethodPatch:
+		patchHandler(w, r, pathTokens)
+		return
+	case http.MethodPut:
+		putHandler(w, r, pathTokens)
+		return
+	case http.MethodHead:
+		headHandler(w, r, pathTokens)
+		return
+	case http.MethodDelete:
+		deleteHandler(w, r, pathTokens)
+		return
 	}
 	w.WriteHeader(http.StatusNotFound)
 }
@@ -204,11 +338,15 @@ func main() {
 	log.Printf("Using the Google Vision API, because credentials are mounted")
 
 	docExtractor = Getenv("DOC_EXTRACTOR", "http://localhost:9998/tika")
+	indexSetup()
 
 	// Set up the database
 	dbCleanup := dbSetup()
 	defer dbCleanup()
 
+	// Derive thumbnails, extracts and labels in the background
+	jobsSetup()
+
 	// this hangs unti the server dies
 	httpSetup()
 }
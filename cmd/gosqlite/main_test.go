@@ -0,0 +1,88 @@
+package main
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Cookies for an admin and for an ordinary user
+const (
+	testAdmin = "admin-secret"
+	testUser  = "user-secret"
+)
+
+// Run handlers in a scratch directory, with a fresh schema.db and two users
+func testServer(t *testing.T) {
+	schema, err := ioutil.ReadFile("../../schema.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	db, err := sql.Open("sqlite3", filepath.Join(dir, "schema.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(string(schema))
+	if err != nil {
+		db.Close()
+		t.Skipf("the schema needs fts5, so use -tags fts5: %v", err)
+	}
+	err = os.Chdir(dir)
+	if err != nil {
+		db.Close()
+		t.Fatal(err)
+	}
+	oldDB, oldConfig := theDB, theConfig
+	theDB = db
+	theConfig = Config{
+		Users: map[UserSecret]User{
+			testAdmin: {"name": {"robf"}, "role": {"admin", "user"}},
+			testUser:  {"name": {"danicaf"}, "role": {"user"}},
+		},
+	}
+	t.Cleanup(func() {
+		theDB, theConfig = oldDB, oldConfig
+		db.Close()
+		os.Chdir(wd)
+	})
+}
+
+func testRequest(t *testing.T, method string, url string, account string, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(method, url, strings.NewReader(body))
+	if account != "" {
+		r.AddCookie(&http.Cookie{Name: "account", Value: account})
+	}
+	w := httptest.NewRecorder()
+	rootRouter(w, r)
+	return w
+}
+
+// Fail unless the request gets the status
+func testStatus(t *testing.T, method string, url string, account string, body string, status int) *httptest.ResponseRecorder {
+	t.Helper()
+	w := testRequest(t, method, url, account, body)
+	if w.Code != status {
+		t.Fatalf("%s %s = %d %s, want %d", method, url, w.Code, strings.TrimSpace(w.Body.String()), status)
+	}
+	return w
+}
+
+// Only robf may write under /files/robf
+const testOwnerPolicy = `package gosqlite
+default Read = true
+default Write = false
+Write {
+  input.name[_] == "robf"
+}
+`
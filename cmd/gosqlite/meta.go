@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// /meta/robf/docs/resume.pdf is stored beside the file as resume.pdf--attributes.json,
+// which is where getAttrs looks for it.  The file itself need not exist yet.
+func metaTarget(pathTokens []string) (string, string) {
+	parentDir := "/files"
+	if len(pathTokens) > 3 {
+		parentDir += "/" + strings.Join(pathTokens[2:len(pathTokens)-1], "/")
+	}
+	return parentDir, pathTokens[len(pathTokens)-1]
+}
+
+var ErrMetaName = errors.New("meta is posted to a file or directory name, without a trailing slash")
+
+func readMeta(parentDir string, name string) (map[string]interface{}, error) {
+	attrs := make(map[string]interface{})
+	jf, err := ioutil.ReadFile("." + parentDir + "/" + name + "--attributes.json")
+	if os.IsNotExist(err) {
+		return attrs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(jf, &attrs)
+	return attrs, err
+}
+
+// Merge as in a json merge patch: null removes a key, objects merge recursively
+func mergeMeta(attrs map[string]interface{}, patch map[string]interface{}) map[string]interface{} {
+	for k, v := range patch {
+		if v == nil {
+			delete(attrs, k)
+			continue
+		}
+		vPatch, vIsObj := v.(map[string]interface{})
+		existing, existingIsObj := attrs[k].(map[string]interface{})
+		if vIsObj && existingIsObj {
+			attrs[k] = mergeMeta(existing, vPatch)
+		} else {
+			attrs[k] = v
+		}
+	}
+	return attrs
+}
+
+func getMetaHandler(w http.ResponseWriter, r *http.Request, pathTokens []string) {
+	parentDir, name := metaTarget(pathTokens)
+	if name == "" {
+		HandleReturnedStatus(w, http.StatusBadRequest, ErrMetaName, "meta for %s: %v", r.URL.Path)
+		return
+	}
+	if !CanRead(GetUser(r), parentDir, name) {
+		HandleReturnedStatus(w, http.StatusForbidden, ErrReadDenied, "Could not read meta for %s: %v", parentDir+"/"+name)
+		return
+	}
+	attrs, err := readMeta(parentDir, name)
+	if err != nil {
+		HandleError(w, err, "Could not read meta for %s: %v", parentDir+"/"+name)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(AsJson(attrs)))
+}
+
+// POST replaces the attributes, while PATCH merges into them
+func postMetaHandler(w http.ResponseWriter, r *http.Request, pathTokens []string) {
+	defer r.Body.Close()
+	parentDir, name := metaTarget(pathTokens)
+	if name == "" {
+		HandleReturnedStatus(w, http.StatusBadRequest, ErrMetaName, "meta for %s: %v", r.URL.Path)
+		return
+	}
+
+	posted := make(map[string]interface{})
+	err := json.NewDecoder(r.Body).Decode(&posted)
+	if err != nil {
+		HandleReturnedStatus(w, http.StatusBadRequest, err, "meta for %s must be a json object: %v", parentDir+"/"+name)
+		return
+	}
+
+	attrs := posted
+	if r.Method == http.MethodPatch {
+		attrs, err = readMeta(parentDir, name)
+		if err != nil {
+			HandleError(w, err, "Could not read meta for %s: %v", parentDir+"/"+name)
+			return
+		}
+		attrs = mergeMeta(attrs, posted)
+	}
+
+	// This goes through the same permission check and indexing as any upload
+	content := AsJson(attrs)
+	err = postFileHandler(w, r, bytes.NewReader([]byte(content)), "meta", parentDir, name+"--attributes.json", parentDir, name, true)
+	if err != nil {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(content))
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+var ErrMoveTarget = errors.New("move needs a to parameter, such as to=/files/robf/docs/resume.pdf")
+var ErrMoveExists = errors.New("destination already exists")
+var ErrMoveIntoSelf = errors.New("cannot move a directory into itself")
+var ErrMoveDirToPermission = errors.New("a directory cannot be moved to a permission name")
+
+// Columns that locate a file, in every table that refers to files by path and name
+var fileColumns = []struct {
+	table string
+	path  string
+	name  string
+}{
+	{"filesearch", "path", "name"},
+	{"filesearch", "original_path", "original_name"},
+	{"filemeta", "path", "name"},
+	{"permissionversion", "path", "name"},
+	{"fileversion", "path", "name"},
+	{"job", "path", "name"},
+}
+
+// Rewrite rows for a file and everything derived from it, or for a whole directory when isDir.
+// Derived names keep their suffix, so resume.pdf--extract.txt becomes cv.pdf--extract.txt
+func moveRows(tx *sql.Tx, srcParent string, srcName string, dstParent string, dstName string, isDir bool) error {
+	names := append([]string{srcName}, siblingNames(srcName)...)
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(names)), ",")
+	for _, c := range fileColumns {
+		args := []interface{}{dstParent + "/", dstName, srcName, srcParent + "/"}
+		for _, n := range names {
+			args = append(args, n)
+		}
+		_, err := tx.Exec(
+			`UPDATE `+c.table+` SET `+c.path+` = ?, `+c.name+` = ? || substr(`+c.name+`, length(?) + 1)
+			 WHERE `+c.path+` = ? AND `+c.name+` IN (`+placeholders+`)`,
+			args...,
+		)
+		if err != nil {
+			return err
+		}
+		if isDir {
+			srcPrefix := srcParent + "/" + srcName + "/"
+			dstPrefix := dstParent + "/" + dstName + "/"
+			_, err = tx.Exec(
+				`UPDATE `+c.table+` SET `+c.path+` = ? || substr(`+c.path+`, length(?) + 1)
+				 WHERE substr(`+c.path+`, 1, length(?)) = ?`,
+				dstPrefix, srcPrefix, srcPrefix, srcPrefix,
+			)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	// Derived files in the catalog name what they came from
+	_, err := tx.Exec(
+		`UPDATE filemeta SET derivedOf = ? WHERE path = ? AND derivedOf = ?`,
+		dstName, dstParent+"/", srcName,
+	)
+	return err
+}
+
+// Last renamed is the first put back, as a file may have been renamed inside a directory that was
+func undoRenames(renames [][2]string) {
+	for i := len(renames) - 1; i >= 0; i-- {
+		os.Rename(renames[i][1], renames[i][0])
+	}
+}
+
+// POST /move/robf/docs/resume.pdf?to=/files/robf/cv.pdf moves a file or directory,
+// along with its derived files, attributes, permission, and rows in the database.
+func postMoveHandler(w http.ResponseWriter, r *http.Request, pathTokens []string) {
+	defer r.Body.Close()
+	src := path.Clean("/files/" + strings.Join(pathTokens[2:], "/"))
+	to := r.URL.Query().Get("to")
+	dst := path.Clean(to)
+	if to == "" || !strings.HasPrefix(dst, "/files/") || src == "/files" {
+		HandleReturnedStatus(w, http.StatusBadRequest, ErrMoveTarget, "Could not move %s: %v", src)
+		return
+	}
+	if strings.HasPrefix(dst+"/", src+"/") {
+		HandleReturnedStatus(w, http.StatusBadRequest, ErrMoveIntoSelf, "Could not move %s to %s: %v", src, dst)
+		return
+	}
+	srcParent, srcName := path.Dir(src), path.Base(src)
+	dstParent, dstName := path.Dir(dst), path.Base(dst)
+
+	// Attributes may have been posted before the file ever was
+	isDir := false
+	found := false
+	if s, err := os.Stat("." + src); err == nil {
+		isDir = s.IsDir()
+		found = true
+	}
+	renames := [][2]string{}
+	for _, n := range append([]string{srcName}, siblingNames(srcName)...) {
+		if _, err := os.Stat("." + srcParent + "/" + n); err == nil {
+			found = true
+			renames = append(renames, [2]string{
+				"." + srcParent + "/" + n,
+				"." + dstParent + "/" + dstName + strings.TrimPrefix(n, srcName),
+			})
+		}
+	}
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	// Previous versions mirror the files tree, so they move the same way.
+	// Each version of a file is named after it, so that is renamed once its directory has moved.
+	if _, err := os.Stat(versionsDir + src); err == nil {
+		renames = append(renames, [2]string{versionsDir + src, versionsDir + dst})
+		if !isDir && srcName != dstName {
+			versions, _ := ioutil.ReadDir(versionsDir + src)
+			for _, v := range versions {
+				for _, n := range append([]string{srcName}, derivedNames(srcName)...) {
+					if _, err := os.Stat(versionsDir + src + "/" + v.Name() + "/" + n); err == nil {
+						renames = append(renames, [2]string{
+							versionsDir + dst + "/" + v.Name() + "/" + n,
+							versionsDir + dst + "/" + v.Name() + "/" + dstName + strings.TrimPrefix(n, srcName),
+						})
+					}
+				}
+			}
+		}
+	}
+	for _, rename := range renames {
+		if _, err := os.Stat(rename[1]); err == nil {
+			HandleReturnedStatus(w, http.StatusConflict, ErrMoveExists, "Could not move %s to %s: %v", src, dst)
+			return
+		}
+	}
+
+	// Moving takes it away from the source, so that is checked like a delete
+	user := GetUser(r)
+	err := canDelete(user, srcParent, srcName, isDir)
+	if err == nil {
+		if (isDir && !CanWrite(user, dst, "")) || (!isDir && !CanWrite(user, dstParent, dstName)) {
+			err = ErrWriteDenied
+		}
+	}
+	if err == ErrWriteDenied || err == ErrAdminRequired {
+		HandleReturnedStatus(w, http.StatusForbidden, err, "Could not move %s to %s: %v", src, dst)
+		return
+	}
+	if err != nil {
+		HandleError(w, err, "Could not check %s for move: %v", src)
+		return
+	}
+	// Moving something into place as a policy installs it, so it is checked like posting one
+	var policy []byte
+	if IsPermissionFile(dstName) {
+		if isDir {
+			HandleReturnedStatus(w, http.StatusBadRequest, ErrMoveDirToPermission, "Could not move %s to %s: %v", src, dst)
+			return
+		}
+		policy, err = ioutil.ReadFile("." + src)
+		if err != nil {
+			HandleError(w, err, "Could not read %s: %v", src)
+			return
+		}
+		status, err := checkPermission(user, policy)
+		if err != nil {
+			HandleReturnedStatus(w, status, err, "Could not move %s to %s: %v", src, dst)
+			return
+		}
+	}
+	fits, err := moveFits(src, dst)
+	if err != nil {
+		HandleError(w, err, "Could not check quota for %s: %v", dst)
+		return
+	}
+	if !fits {
+		HandleReturnedStatus(w, http.StatusInsufficientStorage, ErrQuotaExceeded, "Could not move %s to %s: %v", src, dst)
+		return
+	}
+
+	tx, err := theDB.Begin()
+	if err != nil {
+		HandleError(w, err, "Could not begin move of %s: %v", src)
+		return
+	}
+	defer tx.Rollback()
+	err = moveRows(tx, srcParent, srcName, dstParent, dstName, isDir)
+	if err != nil {
+		HandleError(w, err, "Could not move rows for %s: %v", src)
+		return
+	}
+
+	err = os.MkdirAll("."+dstParent, 0777)
+	if err != nil {
+		HandleError(w, err, "Could not create path for %s: %v", dst)
+		return
+	}
+	err = os.MkdirAll(versionsDir+dstParent, 0777)
+	if err != nil {
+		HandleError(w, err, "Could not create versions path for %s: %v", dst)
+		return
+	}
+	for i, rename := range renames {
+		err = os.Rename(rename[0], rename[1])
+		if err != nil {
+			// Put back what we already moved, as the rows are rolled back
+			undoRenames(renames[:i])
+			HandleError(w, err, "Could not move %s: %v", rename[0])
+			return
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		undoRenames(renames)
+		HandleError(w, err, "Could not commit move of %s: %v", src)
+		return
+	}
+	if policy != nil {
+		err = recordPermission(user, dstParent, dstName, policy)
+		if err != nil {
+			HandleError(w, err, "Could not record permission %s: %v", dst)
+			return
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"testing"
+)
+
+// Moving to or from a policy name changes a policy, which takes an admin and a policy that compiles
+func TestMovePermission(t *testing.T) {
+	testServer(t)
+	testStatus(t, http.MethodPost, "/files/robf/secret.pdf", testAdmin, "secret", http.StatusOK)
+	testStatus(t, http.MethodPost, "/files/robf/secret.pdf--permission.rego", testAdmin, testOwnerPolicy, http.StatusOK)
+	testStatus(t, http.MethodPost, "/files/robf/other.pdf", testAdmin, "other", http.StatusOK)
+	testStatus(t, http.MethodPost, "/files/robf/evil.rego", testUser, testOwnerPolicy, http.StatusOK)
+	testStatus(t, http.MethodPost, "/files/robf/broken.rego", testUser, "package gosqlite\nWrite {", http.StatusOK)
+
+	testStatus(t, http.MethodPost, "/move/robf/evil.rego?to=/files/robf/other.pdf--permission.rego", testUser, "", http.StatusForbidden)
+	testStatus(t, http.MethodPost, "/move/robf/secret.pdf--permission.rego?to=/files/robf/policy.txt", testUser, "", http.StatusForbidden)
+	testStatus(t, http.MethodPost, "/move/robf/broken.rego?to=/files/robf/other.pdf--permission.rego", testAdmin, "", http.StatusBadRequest)
+	for _, name := range []string{"evil.rego", "broken.rego", "secret.pdf--permission.rego"} {
+		_, err := os.Stat("./files/robf/" + name)
+		if err != nil {
+			t.Fatalf("%s was moved: %v", name, err)
+		}
+	}
+
+	testStatus(t, http.MethodPost, "/move/robf/evil.rego?to=/files/robf/other.pdf--permission.rego", testAdmin, "", http.StatusOK)
+	w := testStatus(t, http.MethodGet, "/permission/robf/other.pdf?version=1", testAdmin, "", http.StatusOK)
+	if w.Body.String() != testOwnerPolicy {
+		t.Fatalf("version 1 of the moved policy is %q", w.Body.String())
+	}
+	testStatus(t, http.MethodPost, "/files/robf/other.pdf", testUser, "mine", http.StatusForbidden)
+}
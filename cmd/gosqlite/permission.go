@@ -0,0 +1,230 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+var ErrWriteDenied = errors.New("write permission denied")
+var ErrReadDenied = errors.New("read permission denied")
+
+// Files that are derived from name use the name--suffix convention,
+// and are regenerated whenever the content of name changes
+var derivedSuffixes = []string{
+	"--thumbnail.png",
+	"--extract.txt",
+	"--labels.json",
+}
+
+// Sidecars describe name, and are posted separately from its content
+var sidecarSuffixes = []string{
+	"--attributes.json",
+	"--permission.rego",
+}
+
+func derivedNames(name string) []string {
+	names := []string{}
+	for _, suffix := range derivedSuffixes {
+		names = append(names, name+suffix)
+	}
+	return names
+}
+
+// Everything that goes along with name when it is deleted or moved
+func siblingNames(name string) []string {
+	names := derivedNames(name)
+	for _, suffix := range sidecarSuffixes {
+		names = append(names, name+suffix)
+	}
+	return names
+}
+
+// Derived files and sidecars share the permission of the file they came from
+func OriginalName(name string) string {
+	for _, suffix := range append(derivedSuffixes, sidecarSuffixes...) {
+		if strings.HasSuffix(name, suffix) {
+			return strings.TrimSuffix(name, suffix)
+		}
+	}
+	return name
+}
+
+// An action is allowed unless the effective policy says otherwise.
+// With no permission.rego anywhere up the tree, everything is allowed.
+func isAllowed(attrs map[string]interface{}, action string) bool {
+	allowed, ok := attrs[action].(bool)
+	if !ok {
+		return true
+	}
+	return allowed
+}
+
+// Resolve the effective policy for parentDir/name, such as /files/app/v1 and index.html.
+// A blank name means the directory parentDir itself.
+func getPermission(user User, parentDir string, name string) map[string]interface{} {
+	fsPath := "." + strings.TrimSuffix(parentDir, "/") + "/"
+	return getAttrsPermission(user, fsPath, name, make(map[string]interface{}))
+}
+
+func CanWrite(user User, parentDir string, name string) bool {
+	return isAllowed(getPermission(user, parentDir, OriginalName(name)), "Write")
+}
+
+func CanRead(user User, parentDir string, name string) bool {
+	return isAllowed(getPermission(user, parentDir, OriginalName(name)), "Read")
+}
+
+var ErrAdminRequired = errors.New("changing a permission requires the admin role")
+
+// A policy for a directory is permission.rego inside of it,
+// and a policy for a single file is name--permission.rego beside it.
+func IsPermissionFile(name string) bool {
+	return name == "permission.rego" || strings.HasSuffix(name, "--permission.rego")
+}
+
+// /permission/robf/docs/resume.pdf governs one file, and /permission/robf/docs/ governs a directory
+func permissionTarget(pathTokens []string) (string, string) {
+	parentDir := "/files"
+	if len(pathTokens) > 3 {
+		parentDir += "/" + strings.Join(pathTokens[2:len(pathTokens)-1], "/")
+	}
+	name := pathTokens[len(pathTokens)-1]
+	if name == "" {
+		return parentDir, "permission.rego"
+	}
+	return parentDir, name + "--permission.rego"
+}
+
+type PermissionVersion struct {
+	Version int    `json:"version"`
+	Author  string `json:"author,omitempty"`
+	Created string `json:"created"`
+}
+
+// Only admins may change policies, and only to something that compiles and evaluates.
+// Write is not consulted, so that an admin can recover from a policy that locks everyone out.
+// Returns the http status to fail with.
+func checkPermission(user User, content []byte) (int, error) {
+	if !IsAdmin(user) {
+		return http.StatusForbidden, ErrAdminRequired
+	}
+	_, err := CalculateRego(user, string(content))
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	return http.StatusOK, nil
+}
+
+// Every accepted policy is kept as a new version
+func recordPermission(user User, parentDir string, name string, content []byte) error {
+	_, err := theDB.Exec(
+		`INSERT INTO permissionversion (path, name, version, content, author, created)
+		 SELECT ?, ?, coalesce(max(version), 0) + 1, ?, ?, ? FROM permissionversion WHERE path = ? AND name = ?`,
+		parentDir+"/", name, string(content), UserName(user), time.Now().UTC().Format(time.RFC3339),
+		parentDir+"/", name,
+	)
+	return err
+}
+
+func acceptPermission(w http.ResponseWriter, user User, parentDir string, name string, stream io.Reader) ([]byte, error) {
+	fullName := parentDir + "/" + name
+	content, err := ioutil.ReadAll(stream)
+	if err != nil {
+		return nil, HandleReturnedError(w, err, "Could not read %s: %v", fullName)
+	}
+	err = verifyDigest(w, stream)
+	if err != nil {
+		return nil, HandleReturnedStatus(w, http.StatusBadRequest, err, "Could not write %s: %v", fullName)
+	}
+	status, err := checkPermission(user, content)
+	if err != nil {
+		return nil, HandleReturnedStatus(w, status, err, "Could not write %s: %v", fullName)
+	}
+	err = recordPermission(user, parentDir, name, content)
+	if err != nil {
+		return nil, HandleReturnedError(w, err, "Could not version %s: %v", fullName)
+	}
+	return content, nil
+}
+
+func getPermissionHandler(w http.ResponseWriter, r *http.Request, pathTokens []string) {
+	parentDir, name := permissionTarget(pathTokens)
+	fullName := parentDir + "/" + name
+	if !CanRead(GetUser(r), parentDir, name) {
+		HandleReturnedStatus(w, http.StatusForbidden, ErrReadDenied, "Could not read %s: %v", fullName)
+		return
+	}
+
+	q := r.URL.Query()
+	if q.Get("versions") == "true" {
+		rows, err := theDB.Query(
+			`SELECT version, author, created FROM permissionversion WHERE path = ? AND name = ? ORDER BY version`,
+			parentDir+"/", name,
+		)
+		if err != nil {
+			HandleError(w, err, "Could not list versions of %s: %v", fullName)
+			return
+		}
+		defer rows.Close()
+		versions := []PermissionVersion{}
+		for rows.Next() {
+			var v PermissionVersion
+			rows.Scan(&v.Version, &v.Author, &v.Created)
+			versions = append(versions, v)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(AsJson(versions)))
+		return
+	}
+
+	var content string
+	if version := q.Get("version"); version != "" {
+		err := theDB.QueryRow(
+			`SELECT content FROM permissionversion WHERE path = ? AND name = ? AND version = ?`,
+			parentDir+"/", name, version,
+		).Scan(&content)
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			HandleError(w, err, "Could not read version %s of %s: %v", version, fullName)
+			return
+		}
+	} else {
+		b, err := ioutil.ReadFile("." + fullName)
+		if os.IsNotExist(err) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			HandleError(w, err, "Could not read %s: %v", fullName)
+			return
+		}
+		content = string(b)
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(content))
+}
+
+func postPermissionHandler(w http.ResponseWriter, r *http.Request, pathTokens []string) {
+	defer r.Body.Close()
+	parentDir, name := permissionTarget(pathTokens)
+	body, err := newDigestReader(r, r.Body)
+	if err != nil {
+		HandleReturnedStatus(w, http.StatusBadRequest, err, "Could not write %s: %v", parentDir+"/"+name)
+		return
+	}
+	err = postFileHandler(w, r, body, "permission", parentDir, name, parentDir, OriginalName(name), false)
+	if err != nil {
+		log.Printf("ERR %v", err)
+		return
+	}
+}
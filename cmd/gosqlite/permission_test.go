@@ -0,0 +1,20 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+// Sidecars and derived files are written under the permission of the file they belong to
+func TestWriteBesidePermission(t *testing.T) {
+	testServer(t)
+	testStatus(t, http.MethodPost, "/files/robf/secret.pdf", testAdmin, "secret", http.StatusOK)
+	testStatus(t, http.MethodPost, "/files/robf/secret.pdf--permission.rego", testAdmin, testOwnerPolicy, http.StatusOK)
+
+	testStatus(t, http.MethodPost, "/files/robf/secret.pdf", testUser, "mine", http.StatusForbidden)
+	for _, name := range siblingNames("secret.pdf") {
+		testStatus(t, http.MethodPost, "/files/robf/"+name, testUser, "{}", http.StatusForbidden)
+	}
+	testStatus(t, http.MethodPost, "/files/robf/secret.pdf--attributes.json", testAdmin, "{}", http.StatusOK)
+	testStatus(t, http.MethodPost, "/files/robf/other.pdf--attributes.json", testUser, "{}", http.StatusOK)
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+var ErrQueryEmpty = errors.New("match is required, such as match=king")
+var ErrQuerySyntax = errors.New("could not parse match")
+var ErrQueryMode = errors.New("syntax must be plain or advanced")
+
+// Columns that may be searched on their own, such as name:resume.
+// They are the names of the file that was uploaded, rather than of what was derived from it.
+var queryColumns = map[string]string{
+	"name":    "original_name",
+	"path":    "original_path",
+	"content": "content",
+}
+
+type queryTokenKind int
+
+const (
+	queryWord queryTokenKind = iota
+	queryPhrase
+	queryOpen
+	queryClose
+	queryComma
+	queryColon
+	queryStar
+	queryEnd
+)
+
+type queryToken struct {
+	kind queryTokenKind
+	text string
+}
+
+// Quote text as an fts5 string, so that nothing in it is taken as syntax
+func quoteTerm(text string) string {
+	return `"` + strings.ReplaceAll(text, `"`, `""`) + `"`
+}
+
+// Plain input matches every word in it, whatever punctuation is in them
+func plainMatch(match string) (string, error) {
+	terms := []string{}
+	for _, word := range strings.Fields(match) {
+		terms = append(terms, quoteTerm(word))
+	}
+	if len(terms) == 0 {
+		return "", ErrQueryEmpty
+	}
+	return strings.Join(terms, " "), nil
+}
+
+func lexQuery(match string) ([]queryToken, error) {
+	tokens := []queryToken{}
+	runes := []rune(match)
+	for i := 0; i < len(runes); {
+		c := runes[i]
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '"':
+			// A quote inside of a phrase is written twice, as in fts5
+			text := []rune{}
+			i++
+			for {
+				if i >= len(runes) {
+					return nil, fmt.Errorf("%v: a phrase has no closing \"", ErrQuerySyntax)
+				}
+				if runes[i] == '"' {
+					if i+1 < len(runes) && runes[i+1] == '"' {
+						text = append(text, '"')
+						i += 2
+						continue
+					}
+					i++
+					break
+				}
+				text = append(text, runes[i])
+				i++
+			}
+			tokens = append(tokens, queryToken{queryPhrase, string(text)})
+		case strings.ContainsRune("():,*", c):
+			kind := map[rune]queryTokenKind{'(': queryOpen, ')': queryClose, ',': queryComma, ':': queryColon, '*': queryStar}[c]
+			tokens = append(tokens, queryToken{kind, string(c)})
+			i++
+		default:
+			start := i
+			for i < len(runes) && !unicode.IsSpace(runes[i]) && !strings.ContainsRune(`"():,*`, runes[i]) {
+				i++
+			}
+			tokens = append(tokens, queryToken{queryWord, string(runes[start:i])})
+		}
+	}
+	return append(tokens, queryToken{queryEnd, ""}), nil
+}
+
+// Advanced input is parsed, and written back out as fts5 with every term quoted:
+//
+//	"annual report"        a phrase
+//	budget*                words that begin with budget
+//	NEAR(budget deficit, 5) both, within 5 words of each other
+//	a AND b, a OR b, a NOT b, and (parentheses), where a b is a AND b
+//	name:resume            only in the name, path or content
+type queryParser struct {
+	tokens []queryToken
+	i      int
+}
+
+func (p *queryParser) peek() queryToken {
+	return p.tokens[p.i]
+}
+
+func (p *queryParser) next() queryToken {
+	t := p.tokens[p.i]
+	if t.kind != queryEnd {
+		p.i++
+	}
+	return t
+}
+
+func (p *queryParser) isKeyword(words ...string) bool {
+	t := p.peek()
+	if t.kind != queryWord {
+		return false
+	}
+	for _, word := range words {
+		if t.text == word {
+			return true
+		}
+	}
+	return false
+}
+
+// Does the next token begin another term, which is implicitly ANDed
+func (p *queryParser) startsTerm() bool {
+	switch p.peek().kind {
+	case queryPhrase, queryOpen:
+		return true
+	case queryWord:
+		return !p.isKeyword("AND", "OR", "NOT")
+	}
+	return false
+}
+
+func (p *queryParser) unexpected(what string) error {
+	t := p.peek()
+	if t.kind == queryEnd {
+		return fmt.Errorf("%v: %s is missing at the end", ErrQuerySyntax, what)
+	}
+	return fmt.Errorf("%v: %s is expected before %s", ErrQuerySyntax, what, t.text)
+}
+
+func (p *queryParser) parseOr() (string, error) {
+	expr, err := p.parseAnd()
+	if err != nil {
+		return "", err
+	}
+	for p.isKeyword("OR") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return "", err
+		}
+		expr += " OR " + right
+	}
+	return expr, nil
+}
+
+func (p *queryParser) parseAnd() (string, error) {
+	expr, err := p.parseNot()
+	if err != nil {
+		return "", err
+	}
+	for p.isKeyword("AND") || p.startsTerm() {
+		if p.isKeyword("AND") {
+			p.next()
+		}
+		right, err := p.parseNot()
+		if err != nil {
+			return "", err
+		}
+		expr += " AND " + right
+	}
+	return expr, nil
+}
+
+func (p *queryParser) parseNot() (string, error) {
+	expr, err := p.parsePrimary()
+	if err != nil {
+		return "", err
+	}
+	for p.isKeyword("NOT") {
+		p.next()
+		right, err := p.parsePrimary()
+		if err != nil {
+			return "", err
+		}
+		expr += " NOT " + right
+	}
+	return expr, nil
+}
+
+func (p *queryParser) parsePrimary() (string, error) {
+	t := p.peek()
+	switch {
+	case t.kind == queryOpen:
+		p.next()
+		expr, err := p.parseOr()
+		if err != nil {
+			return "", err
+		}
+		if p.peek().kind != queryClose {
+			return "", p.unexpected("a closing )")
+		}
+		p.next()
+		return "(" + expr + ")", nil
+	case p.isKeyword("AND", "OR", "NOT"):
+		return "", fmt.Errorf("%v: %s must come between two terms", ErrQuerySyntax, t.text)
+	case p.isKeyword("NEAR") && p.tokens[p.i+1].kind == queryOpen:
+		return p.parseNear()
+	case t.kind == queryWord && p.tokens[p.i+1].kind == queryColon:
+		column, ok := queryColumns[strings.ToLower(t.text)]
+		if !ok {
+			return "", fmt.Errorf("%v: there is no %s: to search, only name:, path: or content:", ErrQuerySyntax, t.text)
+		}
+		p.next()
+		p.next()
+		if p.peek().kind == queryOpen || p.isKeyword("NEAR") {
+			expr, err := p.parsePrimary()
+			if err != nil {
+				return "", err
+			}
+			return column + " : " + expr, nil
+		}
+		term, err := p.parseTerm()
+		if err != nil {
+			return "", err
+		}
+		return column + " : " + term, nil
+	}
+	return p.parseTerm()
+}
+
+// A word or phrase, which may end with * to match as a prefix
+func (p *queryParser) parseTerm() (string, error) {
+	t := p.peek()
+	if t.kind != queryWord && t.kind != queryPhrase {
+		return "", p.unexpected("a word or phrase")
+	}
+	p.next()
+	term := quoteTerm(t.text)
+	if p.peek().kind == queryStar {
+		p.next()
+		term += "*"
+	}
+	return term, nil
+}
+
+// NEAR(a b "c d", 10)
+func (p *queryParser) parseNear() (string, error) {
+	p.next()
+	p.next()
+	terms := []string{}
+	for p.peek().kind == queryWord || p.peek().kind == queryPhrase {
+		term, err := p.parseTerm()
+		if err != nil {
+			return "", err
+		}
+		terms = append(terms, term)
+	}
+	if len(terms) == 0 {
+		return "", p.unexpected("a word or phrase in NEAR")
+	}
+	distance := ""
+	if p.peek().kind == queryComma {
+		p.next()
+		t := p.next()
+		if t.kind != queryWord || strings.Trim(t.text, "0123456789") != "" {
+			return "", fmt.Errorf("%v: NEAR takes a number of words after the comma, such as NEAR(a b, 10)", ErrQuerySyntax)
+		}
+		distance = ", " + t.text
+	}
+	if p.peek().kind != queryClose {
+		return "", p.unexpected("a closing ) for NEAR")
+	}
+	p.next()
+	return "NEAR(" + strings.Join(terms, " ") + distance + ")", nil
+}
+
+func advancedMatch(match string) (string, error) {
+	tokens, err := lexQuery(match)
+	if err != nil {
+		return "", err
+	}
+	if len(tokens) == 1 {
+		return "", ErrQueryEmpty
+	}
+	p := &queryParser{tokens: tokens}
+	expr, err := p.parseOr()
+	if err != nil {
+		return "", err
+	}
+	if p.peek().kind != queryEnd {
+		if p.peek().kind == queryClose {
+			return "", fmt.Errorf("%v: there is a ) without a matching (", ErrQuerySyntax)
+		}
+		return "", p.unexpected("AND, OR or NOT")
+	}
+	return expr, nil
+}
+
+// Turn what the user typed into an fts5 match.
+// syntax=plain (the default) matches every word as it is, and syntax=advanced takes operators.
+func parseMatch(match string, syntax string) (string, error) {
+	switch syntax {
+	case "", "plain":
+		return plainMatch(match)
+	case "advanced":
+		return advancedMatch(match)
+	}
+	return "", ErrQueryMode
+}
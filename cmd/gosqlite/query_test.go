@@ -0,0 +1,130 @@
+package main
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+var matchTests = []struct {
+	match  string
+	syntax string
+	want   string
+	err    bool
+}{
+	{`lazy dog`, "", `"lazy" "dog"`, false},
+	{`e-mail bob@example.com:`, "plain", `"e-mail" "bob@example.com:"`, false},
+	{`"quoted`, "", `"""quoted"`, false},
+	{`NOT name:x`, "", `"NOT" "name:x"`, false},
+	{`   `, "", "", true},
+	{`x`, "fancy", "", true},
+
+	{`"lazy dog"`, "advanced", `"lazy dog"`, false},
+	{`"say ""hi"""`, "advanced", `"say ""hi"""`, false},
+	{`fox*`, "advanced", `"fox"*`, false},
+	{`e-mail`, "advanced", `"e-mail"`, false},
+	{`quick brown`, "advanced", `"quick" AND "brown"`, false},
+	{`dog NOT lazy`, "advanced", `"dog" NOT "lazy"`, false},
+	{`a OR b c`, "advanced", `"a" OR "b" AND "c"`, false},
+	{`dog AND (lazy OR another)`, "advanced", `"dog" AND ("lazy" OR "another")`, false},
+	{`NEAR(quick dog)`, "advanced", `NEAR("quick" "dog")`, false},
+	{`NEAR(quick "lazy dog", 10)`, "advanced", `NEAR("quick" "lazy dog", 10)`, false},
+	{`name:resume`, "advanced", `original_name : "resume"`, false},
+	{`Path:docs*`, "advanced", `original_path : "docs"*`, false},
+	{`name:(dogs OR cats)`, "advanced", `original_name : ("dogs" OR "cats")`, false},
+	{`content:NEAR(a b, 2)`, "advanced", `content : NEAR("a" "b", 2)`, false},
+	{`and or not`, "advanced", `"and" AND "or" AND "not"`, false},
+
+	{``, "advanced", "", true},
+	{`"unterminated`, "advanced", "", true},
+	{`(dog`, "advanced", "", true},
+	{`dog)`, "advanced", "", true},
+	{`((dog)`, "advanced", "", true},
+	{`()`, "advanced", "", true},
+	{`NOT dog`, "advanced", "", true},
+	{`dog AND`, "advanced", "", true},
+	{`dog OR OR cat`, "advanced", "", true},
+	{`foo:bar`, "advanced", "", true},
+	{`name:`, "advanced", "", true},
+	{`NEAR()`, "advanced", "", true},
+	{`NEAR(a b, x)`, "advanced", "", true},
+	{`NEAR(a b`, "advanced", "", true},
+	{`*`, "advanced", "", true},
+	{`a , b`, "advanced", "", true},
+}
+
+func TestParseMatch(t *testing.T) {
+	for _, test := range matchTests {
+		got, err := parseMatch(test.match, test.syntax)
+		if test.err {
+			if err == nil {
+				t.Errorf("parseMatch(%q, %q) = %q, want an error", test.match, test.syntax, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseMatch(%q, %q) failed: %v", test.match, test.syntax, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("parseMatch(%q, %q) = %q, want %q", test.match, test.syntax, got, test.want)
+		}
+	}
+}
+
+// The filesearch table just as schema.sql creates it
+func filesearchSchema(t *testing.T) string {
+	b, err := ioutil.ReadFile("../../schema.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := string(b)
+	start := strings.Index(schema, "CREATE VIRTUAL TABLE `filesearch`")
+	if start < 0 {
+		t.Fatal("schema.sql does not create filesearch")
+	}
+	end := strings.Index(schema[start:], ");")
+	if end < 0 {
+		t.Fatal("schema.sql does not finish creating filesearch")
+	}
+	return schema[start : start+end+2]
+}
+
+// Everything that parseMatch accepts must be a valid fts5 match
+func TestParseMatchRuns(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	_, err = db.Exec(filesearchSchema(t))
+	if err != nil {
+		t.Skipf("fts5 is not built in, so use -tags fts5: %v", err)
+	}
+	content := `The quick brown fox jumps over the "lazy" dog`
+	_, err = db.Exec(
+		`INSERT INTO filesearch (path, name, original_path, original_name, content, content_offset, content_length)
+		 VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		"/files/robf/", "a.txt", "/files/robf/", "a.txt", content, 0, len(content),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range matchTests {
+		match, err := parseMatch(test.match, test.syntax)
+		if err != nil {
+			continue
+		}
+		rows, err := db.Query(`SELECT rowid FROM filesearch WHERE filesearch MATCH ?`, match)
+		if err == nil {
+			for rows.Next() {
+			}
+			err = rows.Err()
+			rows.Close()
+		}
+		if err != nil {
+			t.Errorf("%q from %q does not run: %v", match, test.match, err)
+		}
+	}
+}
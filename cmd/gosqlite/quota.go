@@ -0,0 +1,329 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var ErrQuotaExceeded = errors.New("quota exceeded")
+var ErrQuotaSize = errors.New("quota must be a size such as 500MB or 10GB")
+
+// Quotas limit what is catalogued in filemeta, including what is derived from uploads,
+// along with the versions kept of what was overwritten, and what open upload sessions set aside.
+// A user's quota is the quota attribute in config.json, or else defaultQuota,
+// and anonymousQuota is shared by everyone who is not logged in:
+//
+//	"users": {"...": {"name": ["danicaf"], "quota": ["10GB"]}},
+//	"defaultQuota": "1GB",
+//	"anonymousQuota": "0",
+//	"quotas": {"app": "2GB", "documents": "50GB"}
+//
+// quotas limit everything under the top directory of that name, such as /files/app/.
+// Anything without a quota is unlimited.
+type QuotaUsage struct {
+	Name  string `json:"name,omitempty"`
+	Path  string `json:"path,omitempty"`
+	Used  int64  `json:"used"`
+	Limit *int64 `json:"limit,omitempty"`
+}
+
+type Quotas struct {
+	User   QuotaUsage  `json:"user"`
+	Prefix *QuotaUsage `json:"prefix,omitempty"`
+}
+
+var sizeUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"TB", 1024 * 1024 * 1024 * 1024},
+	{"GB", 1024 * 1024 * 1024},
+	{"MB", 1024 * 1024},
+	{"KB", 1024},
+	{"B", 1},
+}
+
+// Parse a size such as 500MB, 10 GB or 1048576
+func parseSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	unit := int64(1)
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(s, u.suffix) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, u.suffix))
+			unit = u.size
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, ErrQuotaSize
+	}
+	return n * unit, nil
+}
+
+// Returns false when there is no quota
+func quotaSize(s string) (int64, bool) {
+	if s == "" {
+		return 0, false
+	}
+	n, err := parseSize(s)
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
+
+// Check every quota in the config when it is loaded, rather than when it is first hit
+func validateQuotas() error {
+	sizes := []string{theConfig.DefaultQuota, theConfig.AnonymousQuota}
+	for _, q := range theConfig.Quotas {
+		sizes = append(sizes, q)
+	}
+	for _, user := range theConfig.Users {
+		sizes = append(sizes, user["quota"]...)
+	}
+	for _, s := range sizes {
+		if s == "" {
+			continue
+		}
+		if _, err := parseSize(s); err != nil {
+			return fmt.Errorf("%v: %s", err, s)
+		}
+	}
+	return nil
+}
+
+func userQuota(user User) (int64, bool) {
+	if len(user["quota"]) > 0 {
+		return quotaSize(user["quota"][0])
+	}
+	if UserName(user) == "" {
+		return quotaSize(theConfig.AnonymousQuota)
+	}
+	return quotaSize(theConfig.DefaultQuota)
+}
+
+// The top directory that parentDir is in, such as /files/app/, and its quota
+func prefixQuota(parentDir string) (string, int64, bool) {
+	tokens := strings.Split(strings.TrimPrefix(parentDir+"/", "/files/"), "/")
+	if tokens[0] == "" {
+		return "", 0, false
+	}
+	limit, ok := quotaSize(theConfig.Quotas[tokens[0]])
+	return "/files/" + tokens[0] + "/", limit, ok
+}
+
+// What is catalogued now, and what is kept under ./versions from before it was overwritten
+func catalogUsage(where string, args ...interface{}) (int64, error) {
+	var used int64
+	err := theDB.QueryRow(
+		`SELECT coalesce(sum(contentSize), 0) FROM (
+		   SELECT path, name, contentSize, uploader FROM filemeta
+		   UNION ALL
+		   SELECT path, name, contentSize, uploader FROM fileversion
+		 ) WHERE `+where,
+		args...,
+	).Scan(&used)
+	return used, err
+}
+
+// Usage includes what open upload sessions have set aside, other than the session uploading
+func userUsage(uploader string, uploading string) (int64, error) {
+	used, err := catalogUsage(`coalesce(uploader, '') = ?`, uploader)
+	if err != nil {
+		return 0, err
+	}
+	reserved, err := uploadingUsage(uploading, func(session UploadSession) bool {
+		return session.Uploader == uploader
+	})
+	return used + reserved, err
+}
+
+func prefixUsage(prefix string, uploading string) (int64, error) {
+	used, err := catalogUsage(`substr(path, 1, length(?)) = ?`, prefix, prefix)
+	if err != nil {
+		return 0, err
+	}
+	reserved, err := uploadingUsage(uploading, func(session UploadSession) bool {
+		return strings.HasPrefix(session.Path, prefix)
+	})
+	return used + reserved, err
+}
+
+// Overwritten content is kept as a version, along with what was derived from it,
+// so it still counts.  Sidecars are not kept, and neither is a derived file
+// that is replaced on its own.
+func keptAsVersion(name string, replacedAlone bool) bool {
+	if isDerived(name) {
+		return !replacedAlone
+	}
+	return OriginalName(name) == name && !IsPermissionFile(name)
+}
+
+// What stops counting once the file replacing, or everything under it as a directory, is replaced.
+// Only what was uploaded by uploader counts, unless that is nil.
+func replacedUsage(replacing string, uploader *string) (int64, error) {
+	var freed int64
+	if replacing == "" {
+		return 0, nil
+	}
+	where := `(path || name = ? OR substr(path, 1, length(?)) = ?)`
+	args := []interface{}{replacing, replacing + "/", replacing + "/"}
+	if uploader != nil {
+		where += ` AND coalesce(uploader, '') = ?`
+		args = append(args, *uploader)
+	}
+	rows, err := theDB.Query(`SELECT path, name, coalesce(contentSize, 0) FROM filemeta WHERE `+where, args...)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var p, name string
+		var size int64
+		err = rows.Scan(&p, &name, &size)
+		if err != nil {
+			return 0, err
+		}
+		if !keptAsVersion(name, p+name == replacing) {
+			freed += size
+		}
+	}
+	return freed, rows.Err()
+}
+
+// How much more user may write into parentDir, once what is freed by replacing it is gone,
+// such as a file that is being overwritten or a directory that is being installed over.
+// uploading is the upload session being completed, whose own reservation is what it may use.
+// Returns false when no quota applies.
+func quotaRemaining(user User, parentDir string, replacing string, uploading string) (int64, bool, error) {
+	uploader := UserName(user)
+	remaining := int64(0)
+	limited := false
+	if limit, ok := userQuota(user); ok {
+		used, err := userUsage(uploader, uploading)
+		if err != nil {
+			return 0, false, err
+		}
+		freed, err := replacedUsage(replacing, &uploader)
+		if err != nil {
+			return 0, false, err
+		}
+		remaining = limit - used + freed
+		limited = true
+	}
+	if prefix, limit, ok := prefixQuota(parentDir); ok {
+		used, err := prefixUsage(prefix, uploading)
+		if err != nil {
+			return 0, false, err
+		}
+		freed, err := replacedUsage(replacing, nil)
+		if err != nil {
+			return 0, false, err
+		}
+		if !limited || limit-used+freed < remaining {
+			remaining = limit - used + freed
+		}
+		limited = true
+	}
+	if remaining < 0 {
+		remaining = 0
+	}
+	return remaining, limited, nil
+}
+
+// A move only changes which top directory its files count against.
+// Is there room under the top directory of dst for what is under src, versions and all.
+func moveFits(src string, dst string) (bool, error) {
+	dstPrefix, limit, ok := prefixQuota(dst)
+	if !ok {
+		return true, nil
+	}
+	if srcPrefix, _, _ := prefixQuota(src); srcPrefix == dstPrefix {
+		return true, nil
+	}
+	moved, err := catalogUsage(`(path || name = ? OR substr(path, 1, length(?)) = ?)`, src, src+"/", src+"/")
+	if err != nil {
+		return false, err
+	}
+	used, err := prefixUsage(dstPrefix, "")
+	if err != nil {
+		return false, err
+	}
+	return used+moved <= limit, nil
+}
+
+// Fails once more than remaining bytes are read, for bodies whose length is not known up front
+type quotaReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (q *quotaReader) Read(p []byte) (int, error) {
+	n, err := q.r.Read(p)
+	q.remaining -= int64(n)
+	if q.remaining < 0 {
+		return n, ErrQuotaExceeded
+	}
+	return n, err
+}
+
+// Refuse a write of incoming bytes (or -1 when unknown) up front if it will not fit,
+// and otherwise limit the stream to what is left of the quota
+func checkQuota(w http.ResponseWriter, user User, parentDir string, name string, appending bool, incoming int64, stream io.Reader) (io.Reader, error) {
+	replacing := parentDir + "/" + name
+	if appending {
+		replacing = ""
+	}
+	remaining, limited, err := quotaRemaining(user, parentDir, replacing, "")
+	if err != nil {
+		return nil, HandleReturnedError(w, err, "Could not check quota for %s: %v", parentDir+"/"+name)
+	}
+	if !limited {
+		return stream, nil
+	}
+	if incoming > remaining {
+		return nil, HandleReturnedStatus(w, http.StatusInsufficientStorage, ErrQuotaExceeded, "Could not write %s: %v", parentDir+"/"+name)
+	}
+	return &quotaReader{r: stream, remaining: remaining}, nil
+}
+
+// GET /quota/ shows what the user has used of their quota,
+// and GET /quota/app/v1 also shows what is used under /files/app/
+func getQuotaHandler(w http.ResponseWriter, r *http.Request, pathTokens []string) {
+	user := GetUser(r)
+	name := UserName(user)
+	used, err := userUsage(name, "")
+	if err != nil {
+		HandleError(w, err, "Could not get usage for %s: %v", name)
+		return
+	}
+	quotas := Quotas{
+		User: QuotaUsage{Name: name, Used: used},
+	}
+	if limit, ok := userQuota(user); ok {
+		quotas.User.Limit = &limit
+	}
+	parentDir := strings.TrimSuffix("/files/"+strings.Join(pathTokens[2:], "/"), "/")
+	if prefix, limit, ok := prefixQuota(parentDir); prefix != "" {
+		if !CanRead(user, strings.TrimSuffix(prefix, "/"), "") {
+			HandleReturnedStatus(w, http.StatusForbidden, ErrReadDenied, "Could not read %s: %v", prefix)
+			return
+		}
+		used, err := prefixUsage(prefix, "")
+		if err != nil {
+			HandleError(w, err, "Could not get usage for %s: %v", prefix)
+			return
+		}
+		quotas.Prefix = &QuotaUsage{Path: prefix, Used: used}
+		if ok {
+			quotas.Prefix.Limit = &limit
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(AsJson(quotas)))
+}
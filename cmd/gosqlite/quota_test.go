@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Versions kept of what was overwritten still count
+func TestQuotaVersions(t *testing.T) {
+	testServer(t)
+	theConfig.Users[testUser]["quota"] = []string{"1500B"}
+	content := strings.Repeat("x", 1000)
+
+	testStatus(t, http.MethodPost, "/files/danicaf/a.txt", testUser, content, http.StatusOK)
+	testStatus(t, http.MethodPost, "/files/danicaf/a.txt", testUser, content, http.StatusInsufficientStorage)
+	testStatus(t, http.MethodPost, "/files/danicaf/a.txt", testUser, content[:400], http.StatusOK)
+	testStatus(t, http.MethodPost, "/files/danicaf/a.txt", testUser, content[:400], http.StatusInsufficientStorage)
+
+	// Deleting the file deletes its versions too
+	testStatus(t, http.MethodDelete, "/files/danicaf/a.txt", testUser, "", http.StatusOK)
+	testStatus(t, http.MethodPost, "/files/danicaf/b.txt", testUser, content, http.StatusOK)
+}
+
+// Each open upload session sets aside its whole length
+func TestQuotaUploads(t *testing.T) {
+	testServer(t)
+	theConfig.Users[testUser]["quota"] = []string{"1500B"}
+	upload := func(method string, url string, header string, value string, body string, status int) string {
+		t.Helper()
+		r := httptest.NewRequest(method, url, strings.NewReader(body))
+		r.AddCookie(&http.Cookie{Name: "account", Value: testUser})
+		r.Header.Set(header, value)
+		w := httptest.NewRecorder()
+		rootRouter(w, r)
+		if w.Code != status {
+			t.Fatalf("%s %s = %d %s, want %d", method, url, w.Code, strings.TrimSpace(w.Body.String()), status)
+		}
+		return w.Header().Get("Location")
+	}
+
+	location := upload(http.MethodPost, "/upload/danicaf/a.bin", "Upload-Length", "1000", "", http.StatusCreated)
+	upload(http.MethodPost, "/upload/danicaf/b.bin", "Upload-Length", "1000", "", http.StatusInsufficientStorage)
+	testStatus(t, http.MethodPost, "/files/danicaf/c.txt", testUser, strings.Repeat("x", 600), http.StatusInsufficientStorage)
+	upload(http.MethodPut, location, "Content-Range", "bytes 0-999/1000", strings.Repeat("x", 1000), http.StatusCreated)
+	upload(http.MethodPost, "/upload/danicaf/b.bin", "Upload-Length", "1000", "", http.StatusInsufficientStorage)
+	testStatus(t, http.MethodPost, "/files/danicaf/c.txt", testUser, strings.Repeat("x", 500), http.StatusOK)
+}
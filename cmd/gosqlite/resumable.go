@@ -0,0 +1,428 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrUploadLength = errors.New("Upload-Length must be a positive number of bytes")
+var ErrUploadRange = errors.New("Content-Range must be like bytes 0-1048575/5000000, starting at Upload-Offset")
+var ErrUploadSession = errors.New("no such upload session")
+var ErrUploadTarget = errors.New("uploads are made to a file name, without a trailing slash")
+
+// A large upload can be sent in chunks, and picked up where it left off after a dropped connection:
+//
+//	POST /upload/robf/movie.mp4              Upload-Length: 5000000
+//	   201, Location: /upload/robf/movie.mp4?id=9f86d081884c7d65
+//	PUT  /upload/robf/movie.mp4?id=...       Content-Range: bytes 0-1048575/5000000
+//	   204, Upload-Offset: 1048576
+//	HEAD /upload/robf/movie.mp4?id=...
+//	   200, Upload-Offset: 1048576, Upload-Length: 5000000
+//
+// The PUT that completes it is written to /files/robf/movie.mp4 like any other upload,
+// and answered with 201.  Partial uploads are kept on disk as:
+//
+//	./uploads/9f86d081884c7d65.json
+//	./uploads/9f86d081884c7d65.part
+const uploadsDir = "./uploads"
+
+// Sessions that are not finished within this long are removed
+const uploadExpiry = 7 * 24 * time.Hour
+
+type UploadSession struct {
+	Id       string `json:"id"`
+	Path     string `json:"path"`
+	Length   int64  `json:"length"`
+	Uploader string `json:"uploader,omitempty"`
+	Created  string `json:"created"`
+}
+
+// PUTs to the same session are taken one at a time, so that a retry of a chunk that is
+// still being written waits for it, and then finds that it no longer starts at Upload-Offset
+type uploadLock struct {
+	sync.Mutex
+	waiting int
+}
+
+var uploadLocksGuard sync.Mutex
+var uploadLocks = make(map[string]*uploadLock)
+
+// Returns the unlock
+func lockUpload(id string) func() {
+	uploadLocksGuard.Lock()
+	l, ok := uploadLocks[id]
+	if !ok {
+		l = &uploadLock{}
+		uploadLocks[id] = l
+	}
+	l.waiting++
+	uploadLocksGuard.Unlock()
+	l.Lock()
+	return func() {
+		l.Unlock()
+		uploadLocksGuard.Lock()
+		l.waiting--
+		if l.waiting == 0 {
+			delete(uploadLocks, id)
+		}
+		uploadLocksGuard.Unlock()
+	}
+}
+
+func uploadSessionName(id string) string {
+	return fmt.Sprintf("%s/%s.json", uploadsDir, id)
+}
+
+func uploadPartName(id string) string {
+	return fmt.Sprintf("%s/%s.part", uploadsDir, id)
+}
+
+// /upload/robf/movie.mp4 is written to /files/robf/movie.mp4
+func uploadTarget(r *http.Request, pathTokens []string) (string, string, error) {
+	if strings.HasSuffix(r.URL.Path, "/") || len(pathTokens) < 3 {
+		return "", "", ErrUploadTarget
+	}
+	target := path.Clean("/files/" + strings.Join(pathTokens[2:], "/"))
+	return path.Dir(target), path.Base(target), nil
+}
+
+// Find the session for ?id=, which only the user that began it may use
+func readUploadSession(r *http.Request, target string) (*UploadSession, int64, error) {
+	id := r.URL.Query().Get("id")
+	if _, err := hex.DecodeString(id); err != nil || id == "" {
+		return nil, 0, ErrUploadSession
+	}
+	b, err := ioutil.ReadFile(uploadSessionName(id))
+	if os.IsNotExist(err) {
+		return nil, 0, ErrUploadSession
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	var session UploadSession
+	err = json.Unmarshal(b, &session)
+	if err != nil {
+		return nil, 0, err
+	}
+	if session.Path != target || session.Uploader != UserName(GetUser(r)) {
+		return nil, 0, ErrUploadSession
+	}
+	s, err := os.Stat(uploadPartName(id))
+	if err != nil {
+		return nil, 0, err
+	}
+	return &session, s.Size(), nil
+}
+
+func removeUploadSession(id string) {
+	os.Remove(uploadPartName(id))
+	os.Remove(uploadSessionName(id))
+}
+
+// What open sessions that match have set aside for their whole length, other than the session except,
+// so that sessions begun one after another cannot each take all that is left of a quota
+func uploadingUsage(except string, match func(UploadSession) bool) (int64, error) {
+	entries, err := ioutil.ReadDir(uploadsDir)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var reserved int64
+	for _, entry := range entries {
+		id := strings.TrimSuffix(entry.Name(), ".json")
+		if id == entry.Name() || id == except || time.Since(entry.ModTime()) > uploadExpiry {
+			continue
+		}
+		b, err := ioutil.ReadFile(uploadSessionName(id))
+		if err != nil {
+			// Finished or abandoned since it was listed
+			continue
+		}
+		var session UploadSession
+		if json.Unmarshal(b, &session) == nil && match(session) {
+			reserved += session.Length
+		}
+	}
+	return reserved, nil
+}
+
+// Remove sessions that were abandoned
+func sweepUploads() {
+	entries, err := ioutil.ReadDir(uploadsDir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), ".json") && time.Since(entry.ModTime()) > uploadExpiry {
+			log.Printf("removing abandoned upload %s", entry.Name())
+			removeUploadSession(strings.TrimSuffix(entry.Name(), ".json"))
+		}
+	}
+}
+
+// Parse Content-Range: bytes start-end/total
+func parseContentRange(contentRange string) (int64, int64, int64, error) {
+	var start, end, total int64
+	_, err := fmt.Sscanf(contentRange, "bytes %d-%d/%d", &start, &end, &total)
+	if err != nil || start < 0 || end < start || total <= end {
+		return 0, 0, 0, ErrUploadRange
+	}
+	return start, end, total, nil
+}
+
+// POST /upload/robf/movie.mp4 begins a session
+func postUploadHandler(w http.ResponseWriter, r *http.Request, pathTokens []string) {
+	defer r.Body.Close()
+	parentDir, name, err := uploadTarget(r, pathTokens)
+	if err != nil {
+		HandleReturnedStatus(w, http.StatusBadRequest, err, "Could not begin upload of %s: %v", r.URL.Path)
+		return
+	}
+	target := parentDir + "/" + name
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		HandleReturnedStatus(w, http.StatusBadRequest, ErrUploadLength, "Could not begin upload of %s: %v", target)
+		return
+	}
+	// Refuse up front, rather than after the whole thing is sent.
+	// It is checked again when it is written.
+	user := GetUser(r)
+	if IsPermissionFile(name) {
+		HandleReturnedStatus(w, http.StatusBadRequest, ErrUploadTarget, "Could not begin upload of %s: %v", target)
+		return
+	}
+	if !CanWrite(user, parentDir, name) {
+		HandleReturnedStatus(w, http.StatusForbidden, ErrWriteDenied, "Could not begin upload of %s: %v", target)
+		return
+	}
+	remaining, limited, err := quotaRemaining(user, parentDir, target, "")
+	if err != nil {
+		HandleError(w, err, "Could not check quota for %s: %v", target)
+		return
+	}
+	if limited && length > remaining {
+		HandleReturnedStatus(w, http.StatusInsufficientStorage, ErrQuotaExceeded, "Could not begin upload of %s: %v", target)
+		return
+	}
+
+	sweepUploads()
+	b := make([]byte, 16)
+	_, err = rand.Read(b)
+	if err != nil {
+		HandleError(w, err, "Could not begin upload of %s: %v", target)
+		return
+	}
+	session := UploadSession{
+		Id:       hex.EncodeToString(b),
+		Path:     target,
+		Length:   length,
+		Uploader: UserName(user),
+		Created:  time.Now().UTC().Format(time.RFC3339),
+	}
+	err = os.MkdirAll(uploadsDir, 0777)
+	if err == nil {
+		err = ioutil.WriteFile(uploadPartName(session.Id), nil, 0644)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(uploadSessionName(session.Id), []byte(AsJson(session)), 0644)
+	}
+	if err != nil {
+		removeUploadSession(session.Id)
+		HandleError(w, err, "Could not begin upload of %s: %v", target)
+		return
+	}
+	w.Header().Set("Location", fmt.Sprintf("/upload%s?id=%s", strings.TrimPrefix(target, "/files"), session.Id))
+	w.Header().Set("Upload-Offset", "0")
+	w.Header().Set("Upload-Length", strconv.FormatInt(length, 10))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte(AsJson(session)))
+}
+
+// HEAD /upload/robf/movie.mp4?id=... says where to resume from
+func headUploadHandler(w http.ResponseWriter, r *http.Request, pathTokens []string) {
+	parentDir, name, err := uploadTarget(r, pathTokens)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	session, offset, err := readUploadSession(r, parentDir+"/"+name)
+	if err == ErrUploadSession {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		HandleError(w, err, "Could not read upload of %s: %v", parentDir+"/"+name)
+		return
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(session.Length, 10))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+}
+
+// PUT /upload/robf/movie.mp4?id=... appends a chunk, which must begin at Upload-Offset.
+// Whatever arrives of a chunk is kept, even if the connection drops.
+func putUploadHandler(w http.ResponseWriter, r *http.Request, pathTokens []string) {
+	defer r.Body.Close()
+	parentDir, name, err := uploadTarget(r, pathTokens)
+	if err != nil {
+		HandleReturnedStatus(w, http.StatusBadRequest, err, "Could not upload to %s: %v", r.URL.Path)
+		return
+	}
+	target := parentDir + "/" + name
+	unlock := lockUpload(r.URL.Query().Get("id"))
+	defer unlock()
+	session, offset, err := readUploadSession(r, target)
+	if err == ErrUploadSession {
+		HandleReturnedStatus(w, http.StatusNotFound, err, "Could not upload to %s: %v", target)
+		return
+	}
+	if err != nil {
+		HandleError(w, err, "Could not read upload of %s: %v", target)
+		return
+	}
+	w.Header().Set("Upload-Length", strconv.FormatInt(session.Length, 10))
+
+	start, end, total, err := parseContentRange(r.Header.Get("Content-Range"))
+	if err == nil && total != session.Length {
+		err = ErrUploadRange
+	}
+	if err != nil {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		HandleReturnedStatus(w, http.StatusBadRequest, err, "Could not upload to %s: %v", target)
+		return
+	}
+	if start != offset {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		HandleReturnedStatus(w, http.StatusConflict, ErrUploadRange, "Could not upload to %s: %v", target)
+		return
+	}
+
+	f, err := os.OpenFile(uploadPartName(session.Id), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		HandleError(w, err, "Could not open upload of %s: %v", target)
+		return
+	}
+	body, err := newDigestReader(r, r.Body)
+	if err != nil {
+		f.Close()
+		w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		HandleReturnedStatus(w, http.StatusBadRequest, err, "Could not upload to %s: %v", target)
+		return
+	}
+	sz, err := io.CopyN(f, body, end-start+1)
+	if err == io.EOF {
+		// A short chunk is fine, as the client asks where to resume from
+		err = nil
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err == nil {
+		// A digest covers the chunk it was sent with
+		err = verifyDigest(w, body)
+		if err != nil {
+			os.Truncate(uploadPartName(session.Id), offset)
+			w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+			HandleReturnedStatus(w, http.StatusBadRequest, err, "Could not upload to %s: %v", target)
+			return
+		}
+	}
+	offset += sz
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	if err != nil {
+		HandleError(w, err, "Could not write upload of %s (%d bytes written): %v", target, sz)
+		return
+	}
+	if offset < session.Length {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	err = completeUpload(w, r, session, parentDir, name)
+	if err != nil {
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+// Complete, so it goes through the same checks, versioning and derivation as any upload.
+// The part is renamed into place rather than copied, unless uploads are on another filesystem.
+func completeUpload(w http.ResponseWriter, r *http.Request, session *UploadSession, parentDir string, name string) error {
+	target := parentDir + "/" + name
+	user := GetUser(r)
+	if !CanWrite(user, parentDir, name) {
+		return HandleReturnedStatus(w, http.StatusForbidden, ErrWriteDenied, "Could not write %s: %v", target)
+	}
+	remaining, limited, err := quotaRemaining(user, parentDir, target, session.Id)
+	if err != nil {
+		return HandleReturnedError(w, err, "Could not check quota for %s: %v", target)
+	}
+	if limited && session.Length > remaining {
+		return HandleReturnedStatus(w, http.StatusInsufficientStorage, ErrQuotaExceeded, "Could not write %s: %v", target)
+	}
+	err = os.MkdirAll("."+parentDir, 0777)
+	if err != nil {
+		return HandleReturnedError(w, err, "Could not create path for %s: %v", target)
+	}
+
+	// Once the part is moved, the session is finished whether or not the rest works
+	tmp := fmt.Sprintf(".%s/.%s%s%s", parentDir, name, uploadingInfix, session.Id)
+	err = os.Rename(uploadPartName(session.Id), tmp)
+	if err != nil {
+		part, err := os.Open(uploadPartName(session.Id))
+		if err != nil {
+			return HandleReturnedError(w, err, "Could not open upload of %s: %v", target)
+		}
+		tmp, _, err = writeTemp(parentDir, name, part)
+		part.Close()
+		if err != nil {
+			return writeFailed(w, err, 0, target)
+		}
+	}
+	removeUploadSession(session.Id)
+	err = replaceWithTemp(w, tmp, parentDir, name, true)
+	if err != nil {
+		return err
+	}
+	return postWrittenFile(w, r, "files", parentDir, name, parentDir, name, true, true, 0, session.Length)
+}
+
+// DELETE /upload/robf/movie.mp4?id=... abandons an upload
+func deleteUploadHandler(w http.ResponseWriter, r *http.Request, pathTokens []string) {
+	parentDir, name, err := uploadTarget(r, pathTokens)
+	if err != nil {
+		HandleReturnedStatus(w, http.StatusBadRequest, err, "Could not cancel upload to %s: %v", r.URL.Path)
+		return
+	}
+	unlock := lockUpload(r.URL.Query().Get("id"))
+	defer unlock()
+	session, _, err := readUploadSession(r, parentDir+"/"+name)
+	if err == ErrUploadSession {
+		HandleReturnedStatus(w, http.StatusNotFound, err, "Could not cancel upload to %s: %v", parentDir+"/"+name)
+		return
+	}
+	if err != nil {
+		HandleError(w, err, "Could not read upload of %s: %v", parentDir+"/"+name)
+		return
+	}
+	removeUploadSession(session.Id)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -2,53 +2,329 @@ package main
 
 import (
 	"fmt"
+	"html"
 	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
 )
 
-func getSearchHandler(w http.ResponseWriter, r *http.Request, pathTokens []string) {
-	match := r.URL.Query().Get("match")
+// Hits are for files under the search path, so that /search/robf/docs?match=...
+// searches only what is under /files/robf/docs/, including subdirectories unless recursive=false.
+// A path that is a file searches only that file and what was derived from it.
+func searchScope(r *http.Request, pathTokens []string) (string, []interface{}) {
+	if len(pathTokens) < 3 {
+		return "", nil
+	}
+	target := "/files/" + strings.Join(pathTokens[2:], "/")
+	if target == "/files/" {
+		return "", nil
+	}
+	if !strings.HasSuffix(target, "/") {
+		if s, err := os.Stat("." + target); err == nil && !s.IsDir() {
+			return ` AND original_path = ? AND original_name = ?`, []interface{}{path.Dir(target) + "/", path.Base(target)}
+		}
+		target += "/"
+	}
+	if r.URL.Query().Get("recursive") == "false" {
+		return ` AND original_path = ?`, []interface{}{target}
+	}
+	return ` AND substr(original_path, 1, length(?)) = ?`, []interface{}{target, target}
+}
+
+// Hits are ranked by bm25 over every chunk that matches, and only the page asked for is highlighted
+type searchHit struct {
+	rowid int64
+	path  string
+	name  string
+	rank  float64
+}
+
+// Chunks of the same file are grouped, best first, so that a long book is one hit
+type searchDoc struct {
+	path string
+	name string
+	hits []searchHit
+}
+
+const searchLimit = 20
+const searchSnippets = 3
+
+const highlightColumn = `highlight(filesearch,7,'<b style="background-color:yellow">','</b>')`
+const snippetColumn = `snippet(filesearch,7,'<b style="background-color:yellow">','</b>','...',24)`
+
+// A link to the same search, at another offset
+func searchPage(r *http.Request, offset int) string {
+	q := r.URL.Query()
+	q.Set("offset", strconv.Itoa(offset))
+	return r.URL.Path + "?" + q.Encode()
+}
+
+// A link to every matching part of one file, which the search path narrows down to
+func searchParts(r *http.Request, path string, name string) string {
+	q := r.URL.Query()
+	q.Set("parts", "true")
+	q.Del("offset")
+	return "/search" + strings.TrimPrefix(path+name, "/files") + "?" + q.Encode()
+}
+
+// Every readable hit, best first.
+// Hits are filtered by the permission of the file they came from,
+// which also covers derived files such as --extract.txt
+func rankedHits(r *http.Request, match string, scope string, scopeArgs []interface{}) ([]searchHit, error) {
 	rows, err := theDB.Query(`
-		SELECT original_path,original_name,part,highlight(filesearch,7,'<b style="background-color:yellow">','</b>') highlighted 
+		SELECT rowid,original_path,original_name,rank
 		from filesearch
-		where filesearch match ?
-	`, match)
+		where filesearch match ?`+scope+`
+		order by rank`,
+		append([]interface{}{match}, scopeArgs...)...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	user := GetUser(r)
+	readable := make(map[string]bool)
+	hits := []searchHit{}
+	for rows.Next() {
+		var hit searchHit
+		err = rows.Scan(&hit.rowid, &hit.path, &hit.name, &hit.rank)
+		if err != nil {
+			return nil, err
+		}
+		k := hit.path + hit.name
+		if _, ok := readable[k]; !ok {
+			readable[k] = CanRead(user, hit.path, hit.name)
+		}
+		if readable[k] {
+			hits = append(hits, hit)
+		}
+	}
+	return hits, rows.Err()
+}
+
+// Where in the indexed file a part is, which may be an extract rather than the file that was hit
+func hitLocation(path string, name string, offset int64, length int64) string {
+	if offset < 0 {
+		return ""
+	}
+	return fmt.Sprintf("%s%s?offset=%d&length=%d", path, name, offset, length)
+}
+
+// Get the part, its location, and the highlighted content (or a snippet of it) of the chunks in hits.
+// highlight needs the match, so they are looked up again by rowid.
+func hitContexts(match string, column string, hits []searchHit) (map[int64]Node, error) {
+	found := make(map[int64]Node)
+	if len(hits) == 0 {
+		return found, nil
+	}
+	args := []interface{}{match}
+	byRowid := make(map[int64]searchHit)
+	for _, hit := range hits {
+		args = append(args, hit.rowid)
+		byRowid[hit.rowid] = hit
+	}
+	rows, err := theDB.Query(`
+		SELECT rowid,part,path,name,coalesce(content_offset,-1),coalesce(content_length,0),`+column+` highlighted
+		from filesearch
+		where filesearch match ? and rowid in (`+strings.TrimSuffix(strings.Repeat("?,", len(hits)), ",")+`)`,
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var rowid, offset, length int64
+		var path, name string
+		var n Node
+		err = rows.Scan(&rowid, &n.Part, &path, &name, &offset, &length, &n.Context)
+		if err != nil {
+			return nil, err
+		}
+		n.Location = hitLocation(path, name, offset, length)
+		// bm25 is lower for better matches, so it is flipped to make a score
+		hit := byRowid[rowid]
+		n.Path = hit.path
+		n.Name = hit.name
+		n.Score = -hit.rank
+		found[rowid] = n
+	}
+	return found, rows.Err()
+}
+
+// [part 3], linked to where it is when that is known
+func partLink(part int, location string) string {
+	if location == "" {
+		return fmt.Sprintf(`[part %d]`, part)
+	}
+	return fmt.Sprintf(`<a href="%s">[part %d]</a>`, html.EscapeString(location), part)
+}
+
+// Set the links to the pages around this one
+func setPaging(r *http.Request, paging *Paging) {
+	if paging.Offset > 0 {
+		prev := paging.Offset - paging.Limit
+		if prev < 0 || paging.Limit == 0 {
+			prev = 0
+		}
+		paging.Prev = searchPage(r, prev)
+	}
+	if paging.Limit > 0 && paging.Offset+paging.Limit < paging.Total {
+		paging.Next = searchPage(r, paging.Offset+paging.Limit)
+	}
+}
+
+// The page of limit things at offset, out of total
+func pageBounds(total int, limit int, offset int) (int, int) {
+	if offset > total {
+		offset = total
+	}
+	end := total
+	if limit > 0 && offset+limit < total {
+		end = offset + limit
+	}
+	return offset, end
+}
+
+// GET /search/robf/docs?match=... lists files that match, best first, each with its number of
+// matching parts and snippets of the best few of them (snippets=3).
+// parts=true lists every matching part on its own instead, with all of its content highlighted.
+// syntax=advanced takes phrases, prefixes, NEAR, AND, OR, NOT and name: in match.
+func getSearchHandler(w http.ResponseWriter, r *http.Request, pathTokens []string) {
+	q := r.URL.Query()
+	match, err := parseMatch(q.Get("match"), q.Get("syntax"))
+	if err != nil {
+		HandleReturnedStatus(w, http.StatusBadRequest, err, "query %s: %v", q.Get("match"))
+		return
+	}
+	limit, offset, err := parsePaging(q, searchLimit)
+	if err != nil {
+		HandleReturnedStatus(w, http.StatusBadRequest, err, "query %s: %v", match)
+		return
+	}
+	snippets := searchSnippets
+	if v := q.Get("snippets"); v != "" {
+		snippets, err = strconv.Atoi(v)
+		if err != nil || snippets < 0 {
+			HandleReturnedStatus(w, http.StatusBadRequest, ErrPaging, "query %s: %v", match)
+			return
+		}
+	}
+	byPart := q.Get("parts") == "true"
+	scope, scopeArgs := searchScope(r, pathTokens)
+	hits, err := rankedHits(r, match, scope, scopeArgs)
 	if err != nil {
 		HandleError(w, err, "query %s: %v", match)
 		return
 	}
 
-	q := r.URL.Query()
+	listing := Listing{
+		Children: []Node{},
+		Paging: &Paging{
+			Offset: offset,
+			Limit:  limit,
+		},
+	}
+	if byPart {
+		listing.Paging.Total = len(hits)
+		start, end := pageBounds(len(hits), limit, offset)
+		page := hits[start:end]
+		found, err := hitContexts(match, highlightColumn, page)
+		if err != nil {
+			HandleError(w, err, "query %s: %v", match)
+			return
+		}
+		for _, hit := range page {
+			listing.Children = append(listing.Children, found[hit.rowid])
+		}
+	} else {
+		docs := []*searchDoc{}
+		byName := make(map[string]*searchDoc)
+		for _, hit := range hits {
+			k := hit.path + hit.name
+			doc, ok := byName[k]
+			if !ok {
+				doc = &searchDoc{path: hit.path, name: hit.name}
+				byName[k] = doc
+				docs = append(docs, doc)
+			}
+			doc.hits = append(doc.hits, hit)
+		}
+		listing.Paging.Total = len(docs)
+		start, end := pageBounds(len(docs), limit, offset)
+		page := docs[start:end]
+		best := []searchHit{}
+		for _, doc := range page {
+			n := len(doc.hits)
+			if n > snippets {
+				n = snippets
+			}
+			best = append(best, doc.hits[:n]...)
+		}
+		found, err := hitContexts(match, snippetColumn, best)
+		if err != nil {
+			HandleError(w, err, "query %s: %v", match)
+			return
+		}
+		for _, doc := range page {
+			n := Node{
+				Path:  doc.path,
+				Name:  doc.name,
+				Score: -doc.hits[0].rank,
+				Hits:  len(doc.hits),
+				Parts: searchParts(r, doc.path, doc.name),
+			}
+			for i := 0; i < len(doc.hits) && i < snippets; i++ {
+				snippet := found[doc.hits[i].rowid]
+				n.Snippets = append(n.Snippets, Snippet{Part: snippet.Part, Score: snippet.Score, Location: snippet.Location, Context: snippet.Context})
+			}
+			listing.Children = append(listing.Children, n)
+		}
+	}
+	setPaging(r, listing.Paging)
+
 	inJson := q.Get("json") == "true"
 	if inJson {
 		w.Header().Set("Content-Type", "application/json")
-		listing := Listing{
-			Children: []Node{
-				{Name: "files", IsDir: true},
-			},
-		}
-		for rows.Next() {
-			var path, name, highlighted string
-			var part int
-			rows.Scan(&path, &name, &part, &highlighted)
-			listing.Children = append(listing.Children, Node{
-				Path:    path,
-				Name:    name,
-				IsDir:   false,
-				Context: highlighted,
-			})
-		}
 		w.Write([]byte(AsJson(listing)))
 	} else {
 		w.Header().Set("Content-Type", "text/html")
+		first := offset + 1
+		if len(listing.Children) == 0 {
+			first = offset
+		}
+		unit := "files"
+		if byPart {
+			unit = "parts"
+		}
+		w.Write([]byte(fmt.Sprintf(`<p>%d-%d of %d %s</p>`+"\n", first, offset+len(listing.Children), listing.Paging.Total, unit)))
 		w.Write([]byte(`<ul>` + "\n"))
-		for rows.Next() {
-			var path, name, highlighted string
-			var part int
-			rows.Scan(&path, &name, &part, &highlighted)
-			w.Write([]byte(
-				fmt.Sprintf(`<li><a href="%s%s">%s%s [part %d]</a><br>%s`+"<br></li>", path, name, path, name, part, highlighted),
-			))
-		}
-		w.Write([]byte(`</ul>`))
+		for _, n := range listing.Children {
+			if byPart {
+				w.Write([]byte(fmt.Sprintf(
+					`<li><a href="%s%s">%s%s</a> %s<br>%s`+"<br></li>",
+					n.Path, n.Name, n.Path, n.Name, partLink(n.Part, n.Location), n.Context,
+				)))
+				continue
+			}
+			w.Write([]byte(fmt.Sprintf(
+				`<li><a href="%s%s">%s%s</a> <a href="%s">[%d parts]</a><br>`,
+				n.Path, n.Name, n.Path, n.Name, html.EscapeString(n.Parts), n.Hits,
+			)))
+			for _, snippet := range n.Snippets {
+				w.Write([]byte(fmt.Sprintf(`%s %s<br>`, partLink(snippet.Part, snippet.Location), snippet.Context)))
+			}
+			w.Write([]byte(`</li>`))
+		}
+		w.Write([]byte(`</ul>` + "\n"))
+		if listing.Paging.Prev != "" {
+			w.Write([]byte(fmt.Sprintf(`<a href="%s">prev</a>`+"\n", html.EscapeString(listing.Paging.Prev))))
+		}
+		if listing.Paging.Next != "" {
+			w.Write([]byte(fmt.Sprintf(`<a href="%s">next</a>`+"\n", html.EscapeString(listing.Paging.Next))))
+		}
 	}
 }
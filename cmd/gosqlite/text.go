@@ -1,8 +1,118 @@
 package main
 
-import "fmt"
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+var ErrTextRange = errors.New("offset and length must be whole numbers of bytes")
+
+// Text is indexed in parts of about indexChunk bytes.  A part ends at a sentence if there is one
+// near its end, or else between words, and never inside of a utf-8 character.
+// Each part begins up to indexOverlap bytes (at a word) before where the last one ended,
+// so that a phrase across the end of a part is found in the next one.
+var indexChunk = 4 * 1024
+var indexOverlap = 0
+
+// INDEX_CHUNK and INDEX_OVERLAP are in bytes.  Overlap is at most half of a part.
+func indexSetup() {
+	chunk, err := strconv.Atoi(Getenv("INDEX_CHUNK", strconv.Itoa(indexChunk)))
+	if err == nil && chunk >= 64 {
+		indexChunk = chunk
+	}
+	overlap, err := strconv.Atoi(Getenv("INDEX_OVERLAP", strconv.Itoa(indexOverlap)))
+	if err == nil && overlap >= 0 {
+		indexOverlap = overlap
+	}
+	if indexOverlap > indexChunk/2 {
+		indexOverlap = indexChunk / 2
+	}
+}
+
+// Where a part ends, given that more follows buf[:size].
+// A sentence is looked for in the last quarter, and then a space in the last half.
+func chunkEnd(buf []byte, size int) int {
+	end := size
+	for i := 0; i < utf8.UTFMax && end > 0 && !utf8.RuneStart(buf[end]); i++ {
+		end--
+	}
+	if !utf8.RuneStart(buf[end]) {
+		// Not utf-8, so there is nothing better than size
+		return size
+	}
+	if i := lastBreak(buf[end*3/4:end], true); i > 0 {
+		return end*3/4 + i
+	}
+	if i := lastBreak(buf[end/2:end], false); i > 0 {
+		return end/2 + i
+	}
+	return end
+}
+
+// Just past the last space in b, or the last one after the end of a sentence.
+// Returns -1 when there is none.
+func lastBreak(b []byte, sentence bool) int {
+	for i := len(b); i > 0; {
+		r, size := utf8.DecodeLastRune(b[:i])
+		if sentence && strings.ContainsRune("。！？", r) {
+			return i
+		}
+		if unicode.IsSpace(r) {
+			p, _ := utf8.DecodeLastRune(b[:i-size])
+			if !sentence || strings.ContainsRune(".!?\n", p) {
+				return i
+			}
+		}
+		i -= size
+	}
+	return -1
+}
+
+// The start of the first word in b[from:to], or to when there is none
+func wordStart(b []byte, from int, to int) int {
+	for i := from; i < to; {
+		r, size := utf8.DecodeRune(b[i:to])
+		i += size
+		if unicode.IsSpace(r) {
+			return i
+		}
+	}
+	return to
+}
+
+// Where the part after one that ends at end begins
+func overlapStart(b []byte, end int) int {
+	from := end - indexOverlap
+	if from < 1 {
+		from = 1
+	}
+	return wordStart(b, from, end)
+}
+
+// The bytes of a file that a search hit links to, as ?offset=4096&length=4021,
+// which is served as a Range of the file
+func textRange(q url.Values) (string, error) {
+	offset, err := strconv.ParseInt(q.Get("offset"), 10, 64)
+	if err != nil || offset < 0 {
+		return "", ErrTextRange
+	}
+	length, err := strconv.ParseInt(q.Get("length"), 10, 64)
+	if err != nil || length < 1 {
+		return "", ErrTextRange
+	}
+	return fmt.Sprintf("bytes=%d-%d", offset, offset+length-1), nil
+}
 
 func indexTextFile(
+	tx *sql.Tx,
 	command string,
 	path string,
 	name string,
@@ -10,10 +120,11 @@ func indexTextFile(
 	originalPath string,
 	originalName string,
 	content []byte,
+	offset int64,
 ) error {
 	// index the file -- if we are appending, we should only incrementally index
-	_, err := theDB.Exec(
-		`INSERT INTO filesearch (cmd, path, name, part, original_path, original_name, content) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+	_, err := tx.Exec(
+		`INSERT INTO filesearch (cmd, path, name, part, original_path, original_name, content, content_offset, content_length) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
 		command,
 		path,
 		name,
@@ -21,9 +132,126 @@ func indexTextFile(
 		originalPath,
 		originalName,
 		content,
+		offset,
+		len(content),
 	)
 	if err != nil {
 		return fmt.Errorf("ERR while indexing %s %s%s: %v", command, path, name, err)
 	}
 	return nil
 }
+
+// Remove the search rows of what was derived from parentDir/name, such as its extract,
+// once its content is replaced.  They come back when it is derived again.
+func unindexDerived(tx *sql.Tx, parentDir string, name string) error {
+	_, err := tx.Exec(`DELETE FROM filesearch WHERE original_path = ? AND original_name = ?`, parentDir+"/", name)
+	return err
+}
+
+// Index a text file in parts, recording where in the file each part came from.
+// When appending, indexing picks up where the last append left off, and the last
+// word is left until more arrives (or eof), as it may not be finished yet.
+// Otherwise, the rows of the previous content are replaced in the same transaction,
+// so that search never sees both versions, or neither.
+func indexFile(
+	command string,
+	parentDir string,
+	name string,
+	originalParentDir string,
+	originalName string,
+	existingSize int64,
+) error {
+	fullName := fmt.Sprintf("%s/%s", parentDir, name)
+	f, err := os.Open("." + fullName)
+	if err != nil {
+		return fmt.Errorf("Could not open file for indexing %s: %v", fullName, err)
+	}
+	defer f.Close()
+
+	tx, err := theDB.Begin()
+	if err != nil {
+		return fmt.Errorf("Could not begin indexing %s: %v", fullName, err)
+	}
+	defer tx.Rollback()
+
+	part := 0
+	// Everything before indexed is already in the index
+	var indexed, start int64
+	if existingSize > 0 {
+		err = tx.QueryRow(
+			`SELECT coalesce(max(part) + 1, 0), coalesce(max(content_offset + content_length), 0) FROM filesearch WHERE path = ? AND name = ?`,
+			parentDir+"/", name,
+		).Scan(&part, &indexed)
+		if err != nil {
+			return fmt.Errorf("Could not find last part of %s: %v", fullName, err)
+		}
+		start = indexed - int64(indexOverlap)
+		if start < 0 {
+			start = 0
+		}
+		_, err = f.Seek(start, io.SeekStart)
+		if err != nil {
+			return fmt.Errorf("Could not seek to %d in %s: %v", start, fullName, err)
+		}
+	} else {
+		_, err = tx.Exec(`DELETE FROM filesearch WHERE path = ? AND name = ?`, parentDir+"/", name)
+		if err != nil {
+			return fmt.Errorf("Could not clean out index of %s: %v", fullName, err)
+		}
+		if parentDir == originalParentDir && name == originalName {
+			err = unindexDerived(tx, parentDir, name)
+			if err != nil {
+				return fmt.Errorf("Could not clean out index of what was derived from %s: %v", fullName, err)
+			}
+		}
+	}
+
+	// buf holds what is not indexed yet, beginning at start in the file
+	buf := []byte{}
+	buffer := make([]byte, indexChunk)
+	eof := false
+	resumed := false
+	for {
+		for !eof && len(buf) <= indexChunk {
+			sz, err := f.Read(buffer)
+			buf = append(buf, buffer[:sz]...)
+			if err == io.EOF {
+				eof = true
+			} else if err != nil {
+				return fmt.Errorf("Could not read %s for indexing: %v", fullName, err)
+			}
+		}
+		if start < indexed && !resumed {
+			// Overlap with what the last append indexed begins at a word
+			skip := wordStart(buf, 0, int(indexed-start))
+			buf = buf[skip:]
+			start += int64(skip)
+		}
+		resumed = true
+		if len(buf) == 0 {
+			break
+		}
+		end := len(buf)
+		last := len(buf) <= indexChunk
+		if !last {
+			end = chunkEnd(buf, indexChunk)
+		} else if command == "append" {
+			end = lastBreak(buf, false)
+		}
+		// Overlap alone has nothing new
+		if end > 0 && start+int64(end) > indexed {
+			err := indexTextFile(tx, command, parentDir+"/", name, part, originalParentDir+"/", originalName, buf[:end], start)
+			if err != nil {
+				return err
+			}
+			part++
+		}
+		if last {
+			break
+		}
+		next := overlapStart(buf, end)
+		buf = append([]byte{}, buf[next:]...)
+		start += int64(next)
+	}
+	return tx.Commit()
+}
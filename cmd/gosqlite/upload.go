@@ -1,16 +1,28 @@
 package main
 
 import (
-	"archive/tar"
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
-	"path"
 	"strings"
+	"time"
 )
 
+var ErrInstallCommand = errors.New("install=true is only for /files/")
+
+// Write a file, and derive whatever we can from it (thumbnails, extracts, labels, search index).
+//
+//	files  - overwrite the file, and derive everything from it
+//	append - append to the file, and only index the new text
+//	eof    - append anything remaining, and then derive everything from the whole file
+//
+// Text is indexed before this returns, while everything else is derived by the job queue.
+//
 // postFileHandler can be re-used as long as err != nil
 func postFileHandler(
 	w http.ResponseWriter,
@@ -26,159 +38,362 @@ func postFileHandler(
 	fullName := fmt.Sprintf("%s/%s", parentDir, name)
 	//log.Printf("create %s %s", command, fullName)
 
-	// Write the file out
-	flags := os.O_WRONLY | os.O_CREATE
-
-	// We either append content, or overwrite it entirely
-	if command == "append" {
-		flags |= os.O_APPEND
-	} else {
-		flags |= os.O_TRUNC
+	user := GetUser(r)
+	if IsPermissionFile(name) {
+		// Policies are code, so they are checked before anything is written
+		content, err := acceptPermission(w, user, parentDir, name, stream)
+		if err != nil {
+			return err
+		}
+		stream = bytes.NewReader(content)
+	} else if !CanWrite(user, originalParentDir, originalName) {
+		// Derived files are written under the permission of their original
+		return HandleReturnedStatus(w, http.StatusForbidden, ErrWriteDenied, "Could not write %s: %v", originalParentDir+"/"+originalName)
 	}
 
-	// TODO: check permissions before allowing writes
+	// Refuse what will not fit up front, and stop anything that turns out not to as it is written
+	appending := command == "append" || command == "eof"
+	limited, err := checkQuota(w, user, parentDir, name, appending, r.ContentLength, stream)
+	if err != nil {
+		return err
+	}
 
 	//log.Printf("Ensure existence of parentDir: %s", parentDir)
-	err := os.MkdirAll("."+parentDir, 0777)
+	err = os.MkdirAll("."+parentDir, 0777)
 	if err != nil {
 		return HandleReturnedError(w, err, "Could not create path for %s: %v", r.URL.Path)
 	}
 
 	existingSize := int64(0)
-	s, err := os.Stat("." + fullName)
-	if err == nil {
-		existingSize = s.Size()
+	existed := false
+	if s, err := os.Stat("." + fullName); err == nil {
+		existed = true
+		if appending {
+			existingSize = s.Size()
+		}
 	}
 
-	// Ensure that the file in question exists on disk.
-	if true {
-		f, err := os.Create("." + fullName) //, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	// Keep what an upload is about to overwrite, so that it can be fetched or restored later.
+	// Derived files are kept along with their original, and sidecars have no versions.
+	versioned := cascade && parentDir == originalParentDir && name == originalName &&
+		(command == "files" || !existed)
+
+	var sz int64
+	if appending {
+		// Appends are meant to be seen as they arrive, so they go straight into the file.
+		// Never write through a link to a blob, as other files share it
+		err = unshareBlob("." + fullName)
+		if err != nil {
+			return HandleReturnedError(w, err, "Could not replace file %s: %v", fullName)
+		}
+		f, err := os.OpenFile("."+fullName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
 		if err != nil {
 			return HandleReturnedError(w, err, "Could not create file %s: %v", r.URL.Path)
 		}
+		sz, err = io.Copy(f, limited)
+		f.Close()
+		if err == nil {
+			err = verifyDigest(w, stream)
+		}
+		if err != nil {
+			// Take back what was appended
+			if existed {
+				os.Truncate("."+fullName, existingSize)
+			} else {
+				os.Remove("." + fullName)
+			}
+			return writeFailed(w, err, sz, fullName)
+		}
+	} else {
+		tmp, n, err := writeTemp(parentDir, name, limited)
+		sz = n
+		if err != nil {
+			return writeFailed(w, err, sz, fullName)
+		}
+		err = verifyDigest(w, stream)
+		if err != nil {
+			os.Remove(tmp)
+			return writeFailed(w, err, sz, fullName)
+		}
+		err = replaceWithTemp(w, tmp, parentDir, name, versioned && command == "files")
+		if err != nil {
+			return err
+		}
+	}
+	return postWrittenFile(w, r, command, parentDir, name, originalParentDir, originalName, cascade, versioned, existingSize, sz)
+}
+
+// Writes fail because the client sent something wrong, or went over quota, or because of us
+func writeFailed(w http.ResponseWriter, err error, sz int64, fullName string) error {
+	switch err {
+	case ErrDigestMismatch:
+		return HandleReturnedStatus(w, http.StatusBadRequest, err, "Could not write %s: %v", fullName)
+	case ErrQuotaExceeded:
+		return HandleReturnedStatus(w, http.StatusInsufficientStorage, err, "Could not write %s: %v", fullName)
+	}
+	return HandleReturnedError(w, err, "Could not write to file (%d bytes written) %s: %v", sz, fullName)
+}
+
+// A request body that came with a digest is checked once it is written,
+// and the digest that was computed is sent back
+func verifyDigest(w http.ResponseWriter, stream io.Reader) error {
+	d, ok := stream.(*digestReader)
+	if !ok {
+		return nil
+	}
+	d.setHeaders(w)
+	return d.verify()
+}
 
-		// Save the stream to a file
-		sz, err := io.Copy(f, stream)
-		f.Close() // strange positioning, but we must close before defer can get to it.
+// Uploads are written beside their final name as a hidden file, such as
+// /files/robf/.movie.mp4.uploading-123, and renamed over it only once all of it is on disk.
+// So nobody sees half of an upload, and a dropped connection leaves the previous file as it was.
+const uploadingInfix = ".uploading-"
+
+// Write the stream to a temp file beside parentDir/name, and flush it to disk.
+// The temp file is removed on failure; otherwise it is up to the caller to rename it into place.
+func writeTemp(parentDir string, name string, stream io.Reader) (string, int64, error) {
+	f, err := ioutil.TempFile("."+parentDir, "."+name+uploadingInfix)
+	if err != nil {
+		return "", 0, err
+	}
+	tmp := f.Name()
+	sz, err := io.Copy(f, stream)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		// Temp files are private, but this is about to be served
+		err = f.Chmod(0644)
+	}
+	cerr := f.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return "", sz, err
+	}
+	return tmp, sz, nil
+}
+
+// Rename tmp over parentDir/name, first keeping what it replaces when versioned.
+// tmp is removed if it cannot be put in place.
+func replaceWithTemp(w http.ResponseWriter, tmp string, parentDir string, name string, versioned bool) error {
+	fullName := fmt.Sprintf("%s/%s", parentDir, name)
+	if versioned {
+		err := preserveVersion(parentDir, name)
+		if err != nil {
+			os.Remove(tmp)
+			return HandleReturnedError(w, err, "Could not preserve previous version of %s: %v", fullName)
+		}
+	}
+	// Readers see either all of the old file or all of the new one
+	err := os.Rename(tmp, "."+fullName)
+	if err != nil {
+		os.Remove(tmp)
+		return HandleReturnedError(w, err, "Could not replace file %s: %v", fullName)
+	}
+	return nil
+}
+
+// Once the sz bytes of a file are in place after existingSize: store it as a blob,
+// catalog and version it, index its text, and queue up deriving everything else from it.
+func postWrittenFile(
+	w http.ResponseWriter,
+	r *http.Request,
+	command string,
+	parentDir string,
+	name string,
+	originalParentDir string,
+	originalName string,
+	cascade bool,
+	versioned bool,
+	existingSize int64,
+	sz int64,
+) error {
+	fullName := fmt.Sprintf("%s/%s", parentDir, name)
+	uploader := UserName(GetUser(r))
+
+	contentType, err := catalogWrittenFile(command, parentDir, name, uploader, existingSize, sz)
+	if err != nil {
+		return HandleReturnedError(w, err, "Could not catalog %s: %v", fullName)
+	}
+
+	if versioned {
+		err = recordVersion(parentDir, name, uploader, time.Now())
 		if err != nil {
-			return HandleReturnedError(w, err, "Could not write to file (%d bytes written) %s: %v", sz, r.URL.Path)
+			return HandleReturnedError(w, err, "Could not record version of %s: %v", fullName)
 		}
 	}
 
-	if IsDoc(fullName) && cascade {
+	if !cascade {
+		return nil
+	}
+
+	// Text is indexed as it arrives, so that it is searchable before eof.
+	// Policies are plain text, but are not for searching.
+	if IsPermissionFile(name) {
+		return nil
+	}
+	if IsTextFile(contentType) {
+		err = indexFile(command, parentDir, name, originalParentDir, originalName, existingSize)
+		if err != nil {
+			return HandleReturnedError(w, err, "Could not index file %s: %v", fullName)
+		}
+		return nil
+	}
+
+	// Everything else is derived from the whole file, so it waits for eof.
+	// It can take a while, so the upload does not wait for it.
+	if command == "append" || parentDir != originalParentDir || name != originalName {
+		return nil
+	}
+	// Until then, nothing derived from the previous content may be found by search
+	tx, err := theDB.Begin()
+	if err == nil {
+		defer tx.Rollback()
+		err = unindexDerived(tx, parentDir, name)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		return HandleReturnedError(w, err, "Could not clean out index of what was derived from %s: %v", fullName)
+	}
+	if !isDerivable(contentType) {
+		return nil
+	}
+	err = enqueueDerive(parentDir, name, uploader)
+	if err != nil {
+		return HandleReturnedError(w, err, "Could not queue derivation of %s: %v", fullName)
+	}
+	return nil
+}
+
+// Write something derived from originalParentDir/originalName beside it, such as its thumbnail.
+// Derived files have no versions of their own, as they are kept with the version of their original.
+func writeDerivedFile(
+	stream io.Reader,
+	parentDir string,
+	name string,
+	originalParentDir string,
+	originalName string,
+	uploader string,
+	cascade bool,
+	current func() error,
+) error {
+	fullName := fmt.Sprintf("%s/%s", parentDir, name)
+	tmp, sz, err := writeTemp(parentDir, name, stream)
+	if err != nil {
+		return fmt.Errorf("Could not write %s: %v", fullName, err)
+	}
+	// The original may have gone away while this was being made
+	err = current()
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	err = os.Rename(tmp, "."+fullName)
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("Could not replace file %s: %v", fullName, err)
+	}
+	contentType, err := catalogWrittenFile("files", parentDir, name, uploader, 0, sz)
+	if err != nil {
+		return fmt.Errorf("Could not catalog %s: %v", fullName, err)
+	}
+	if cascade && IsTextFile(contentType) {
+		err = indexFile("files", parentDir, name, originalParentDir, originalName, 0)
+		if err != nil {
+			return fmt.Errorf("Could not index file %s: %v", fullName, err)
+		}
+	}
+	return nil
+}
+
+// Make thumbnails, extracts and labels from a complete file.
+// They are regenerated in full, even when the original was appended to.
+// current says whether the original is still there to write them beside.
+func deriveFile(
+	contentType string,
+	parentDir string,
+	name string,
+	uploader string,
+	current func() error,
+) error {
+	fullName := fmt.Sprintf("%s/%s", parentDir, name)
+
+	if IsDoc(contentType) {
 		// Open the file we wrote
 		f, err := os.Open("." + fullName)
 		if err != nil {
-			return HandleReturnedError(w, err, "Could not open file for indexing %s: %v", fullName)
+			return fmt.Errorf("Could not open file for indexing %s: %v", fullName, err)
 		}
 		// Get a doc extract stream
 		rdr, err := DocExtract(fullName, f)
 		f.Close()
 		if err != nil {
-			return HandleReturnedError(w, err, "Could not extract file for indexing %s: %v", fullName)
+			return fmt.Errorf("Could not extract file for indexing %s: %v", fullName, err)
 		}
-		// Write the doc extract stream like an upload
+		// Write the doc extract, which is indexed as text
 		extractName := fmt.Sprintf("%s--extract.txt", name)
-		err = postFileHandler(w, r, rdr, command, parentDir, extractName, originalParentDir, originalName, cascade)
+		err = writeDerivedFile(rdr, parentDir, extractName, parentDir, name, uploader, true, current)
+		rdr.Close()
 		if err != nil {
-			return HandleReturnedError(w, err, "Could not write extract file for indexing %s: %v", fullName)
+			return fmt.Errorf("Could not write extract file for indexing %s: %v", fullName, err)
 		}
 
-		ext := strings.ToLower(path.Ext(fullName))
-		if ext == ".pdf" {
+		if mediaType(contentType) == "application/pdf" {
 			rdr, err := pdfThumbnail(`./` + fullName)
 			if err != nil {
-				return HandleReturnedError(w, err, "Could not make thumbnail for %s: %v", fullName)
+				return fmt.Errorf("Could not make thumbnail for %s: %v", fullName, err)
 			}
 			// Only png works.  bug in imageMagick.  don't cascade on thumbnails
 			thumbnailName := fmt.Sprintf("%s--thumbnail.png", name)
-			err = postFileHandler(w, r, rdr, command, parentDir, thumbnailName, originalParentDir, originalName, false)
+			err = writeDerivedFile(rdr, parentDir, thumbnailName, parentDir, name, uploader, false, current)
 			if err != nil {
-				return HandleReturnedError(w, err, "Could not write make thumbnail for indexing %s: %v", fullName)
+				return fmt.Errorf("Could not write make thumbnail for indexing %s: %v", fullName, err)
 			}
 		}
-
-		// open the file that we saved, and index it in the database.
 		return nil
 	}
 
-	if IsVideo(fullName) && cascade {
+	if IsVideo(contentType) {
 		rdr, err := videoThumbnail(`./` + fullName)
 		if err != nil {
-			return HandleReturnedError(w, err, "Could not make thumbnail for %s: %v", fullName)
+			return fmt.Errorf("Could not make thumbnail for %s: %v", fullName, err)
 		}
 		thumbnailName := fmt.Sprintf("%s--thumbnail.png", name)
-		err = postFileHandler(w, r, rdr, command, parentDir, thumbnailName, originalParentDir, originalName, false)
+		err = writeDerivedFile(rdr, parentDir, thumbnailName, parentDir, name, uploader, false, current)
 		if err != nil {
-			return HandleReturnedError(w, err, "Could not write make thumbnail for indexing %s: %v", fullName)
+			return fmt.Errorf("Could not write make thumbnail for indexing %s: %v", fullName, err)
 		}
 		return nil
 	}
 
-	if IsImage(fullName) && cascade {
-		if true {
-			rdr, err := makeThumbnail(`./` + fullName)
-			if err != nil {
-				return HandleReturnedError(w, err, "Could not make thumbnail for %s: %v", fullName)
-			}
-			thumbnailName := fmt.Sprintf("%s--thumbnail.png", name)
-			err = postFileHandler(w, r, rdr, command, parentDir, thumbnailName, originalParentDir, originalName, false)
-			if err != nil {
-				return HandleReturnedError(w, err, "Could not write make thumbnail for indexing %s: %v", fullName)
-			}
+	if IsImage(contentType) {
+		rdr, err := makeThumbnail(`./` + fullName)
+		if err != nil {
+			return fmt.Errorf("Could not make thumbnail for %s: %v", fullName, err)
+		}
+		thumbnailName := fmt.Sprintf("%s--thumbnail.png", name)
+		err = writeDerivedFile(rdr, parentDir, thumbnailName, parentDir, name, uploader, false, current)
+		if err != nil {
+			return fmt.Errorf("Could not write make thumbnail for indexing %s: %v", fullName, err)
 		}
 
 		if useVisionAPI {
 			rdr, err := detectLabels(`./` + fullName)
 			if err != nil {
-				return HandleReturnedError(w, err, "Could not extract labels for %s: %v", fullName)
+				return fmt.Errorf("Could not extract labels for %s: %v", fullName, err)
 			}
 			labelName := fmt.Sprintf("%s--labels.json", name)
-			err = postFileHandler(w, r, rdr, command, parentDir, labelName, originalParentDir, originalName, cascade)
+			err = writeDerivedFile(rdr, parentDir, labelName, parentDir, name, uploader, true, current)
 			if err != nil {
-				//return HandleReturnedError(w, err, "Could not write extract file for indexing %s: %v", fullName)
-				log.Printf("Could not write extract file for indexing %s: %v\n", fullName, err)
-				return nil
+				return fmt.Errorf("Could not write labels for indexing %s: %v", fullName, err)
 			}
 		}
-
-		return nil
-	}
-
-	if IsTextFile(fullName) && cascade {
-		// open the file that we saved, and index it in the database.
-		f, err := os.Open("." + fullName)
-		if err != nil {
-			return HandleReturnedError(w, err, "Could not open file for indexing %s: %v", fullName)
-		}
-		defer f.Close()
-		if existingSize > 0 {
-			// we are appending, so we need to start at the end of the file
-			f.Seek(existingSize, 0)
-		}
-		var rdr io.Reader = f
-		/*
-			if command == "files" {
-				// this implies a truncate
-				_, err := theDB.Exec(`DELETE from filesearch where path = ? and name = ? and cmd = ?`, parentDir+"/", name, command)
-				if err != nil {
-					log.Printf("cleaning out fulltextsearch for: %s%s %s failed: %v", parentDir+"/", name, command, err)
-				}
-			}
-		*/
-		buffer := make([]byte, 4*1024)
-		part := 0
-		for {
-			sz, err := rdr.Read(buffer)
-			if err == io.EOF {
-				break
-			}
-			err = indexTextFile(command, parentDir+"/", name, part, originalParentDir+"/", originalName, buffer[:sz])
-			if err != nil {
-				log.Printf("failed indexing: %v", err)
-			}
-			part++
-		}
 		return nil
 	}
 	return nil
@@ -189,11 +404,11 @@ func postFilesHandler(w http.ResponseWriter, r *http.Request, pathTokens []strin
 	defer r.Body.Close()
 
 	q := r.URL.Query()
-	// This is a signal that this is a tar archive
+	// This is a signal that this is an archive (tar, compressed tar, or zip)
 	// that we unpack to install all files at the given url
 	needsInstall := q.Get("install") == "true"
 	if needsInstall {
-		log.Printf("install tarball to %s", r.URL.Path)
+		log.Printf("install archive to %s", r.URL.Path)
 	}
 
 	if len(pathTokens) < 2 {
@@ -202,38 +417,56 @@ func postFilesHandler(w http.ResponseWriter, r *http.Request, pathTokens []strin
 	}
 	command := pathTokens[1]
 	pathTokens[1] = "files"
+	if needsInstall && command != "files" {
+		HandleReturnedStatus(w, http.StatusBadRequest, ErrInstallCommand, "Could not install to %s: %v", r.URL.Path)
+		return
+	}
 
 	// Make sure that the path exists, and get the file name
 	parentDir := strings.Join(pathTokens[:len(pathTokens)-1], "/")
 	name := pathTokens[len(pathTokens)-1]
 
 	// If err != nil, then we can't call this again.  http response has been sent
-	if needsInstall == true { // we ASSUME that it's a tar
-		// We install the tarball, walking it file by file
-		t := tar.NewReader(r.Body)
-		for {
-			header, err := t.Next()
-			if err == io.EOF {
-				break
-			}
-			// Ignore directories for a moment XXX
-			if header.Typeflag == tar.TypeReg {
-				// I assume that header names are unqualified dir names
-				tname := strings.Split(header.Name, "/") // expect . in front
-				tname = tname[1:]
-				tardir := path.Dir(fmt.Sprintf("%s/%s/%s", parentDir, name, strings.Join(tname, "/")))
-				tarname := path.Base(header.Name)
-				log.Printf("writing: %s into %s", tarname, tardir)
-				err = postFileHandler(w, r, t, command, tardir, tarname, tardir, tarname, true)
-				if err != nil {
-					log.Printf("ERR %v", err)
-					return
-				}
-			}
+	if needsInstall == true {
+		err = installHandler(w, r, parentDir, name)
+		if err != nil {
+			log.Printf("ERR %v", err)
+			return
+		}
+	} else if version := q.Get("version"); version != "" && command == "files" {
+		// Restore a previous version, by uploading it again as the newest one
+		fName, err := versionFile(parentDir, name, version)
+		if err == ErrNoVersion {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			HandleError(w, err, "Could not find version %s of %s: %v", version, r.URL.Path)
+			return
+		}
+		if fName == "" {
+			// It is already the current version
+			return
+		}
+		f, err := os.Open(fName)
+		if err != nil {
+			HandleError(w, err, "Could not open version %s of %s: %v", version, r.URL.Path)
+			return
+		}
+		defer f.Close()
+		err = postFileHandler(w, r, f, command, parentDir, name, parentDir, name, true)
+		if err != nil {
+			log.Printf("ERR %v", err)
+			return
 		}
 	} else {
 		// Just a normal single-file upload
-		err = postFileHandler(w, r, r.Body, command, parentDir, name, parentDir, name, true)
+		body, err := newDigestReader(r, r.Body)
+		if err != nil {
+			HandleReturnedStatus(w, http.StatusBadRequest, err, "Could not write %s: %v", r.URL.Path)
+			return
+		}
+		err = postFileHandler(w, r, body, command, parentDir, name, parentDir, name, true)
 		if err != nil {
 			log.Printf("ERR %v", err)
 			return
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 
@@ -18,7 +19,13 @@ type User map[UserAttribute][]string
 // Include users in config for now, to get off the ground
 // The users are mapped to a secret cookie value
 type Config struct {
-	Users map[UserSecret]User `json:"users"`
+	Users        map[UserSecret]User `json:"users"`
+	ContentTypes map[string]string   `json:"contentTypes,omitempty"`
+	IndexedTypes []string            `json:"indexedTypes,omitempty"`
+	// Sizes such as 10GB.  See quota.go
+	DefaultQuota   string            `json:"defaultQuota,omitempty"`
+	AnonymousQuota string            `json:"anonymousQuota,omitempty"`
+	Quotas         map[string]string `json:"quotas,omitempty"`
 }
 
 // Evaluate an opa string against some parsed json claims
@@ -37,8 +44,34 @@ func CalculateRego(claims interface{}, s string) (map[string]interface{}, error)
 	if err != nil {
 		return nil, err
 	}
-	calculation := results[0].Expressions[0].Value.(map[string]interface{})
-	return calculation, err
+	if len(results) == 0 || len(results[0].Expressions) == 0 {
+		return nil, fmt.Errorf("no result for data.gosqlite")
+	}
+	calculation, ok := results[0].Expressions[0].Value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("data.gosqlite is not an object")
+	}
+	return calculation, nil
+}
+
+// The name that we record as the author of changes
+func UserName(user User) string {
+	if len(user["name"]) > 0 {
+		return user["name"][0]
+	}
+	if len(user["email"]) > 0 {
+		return user["email"][0]
+	}
+	return ""
+}
+
+func IsAdmin(user User) bool {
+	for _, role := range user["role"] {
+		if role == "admin" {
+			return true
+		}
+	}
+	return false
 }
 
 func LoadConfig() {
@@ -46,6 +79,7 @@ func LoadConfig() {
 	CheckErr(err, "Could not open config file")
 	err = json.Unmarshal(f, &theConfig)
 	CheckErr(err, "Could not parse config file")
+	CheckErr(validateQuotas(), "Could not parse quotas in config file")
 }
 
 func GetUser(r *http.Request) User {
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Prior versions mirror the files tree, with a directory per version holding
+// the content and whatever was derived from it:
+//
+//	./versions/files/robf/docs/resume.pdf/3/resume.pdf
+//	./versions/files/robf/docs/resume.pdf/3/resume.pdf--thumbnail.png
+//
+// Sidecars such as attributes and permission stay with the file itself.
+const versionsDir = "./versions"
+
+var ErrNoVersion = errors.New("no such version")
+
+type FileVersion struct {
+	Version  int    `json:"version"`
+	Uploader string `json:"uploader,omitempty"`
+	Created  string `json:"created"`
+	Size     int64  `json:"size"`
+	Current  bool   `json:"current,omitempty"`
+}
+
+func versionDir(parentDir string, name string, version int) string {
+	return fmt.Sprintf("%s%s/%s/%d", versionsDir, parentDir, name, version)
+}
+
+func currentVersion(parentDir string, name string) (int, error) {
+	version := 0
+	err := theDB.QueryRow(
+		`SELECT coalesce(max(version), 0) FROM fileversion WHERE path = ? AND name = ?`,
+		parentDir+"/", name,
+	).Scan(&version)
+	return version, err
+}
+
+// Record a new version of parentDir/name as just written by uploader
+func recordVersion(parentDir string, name string, uploader string, created time.Time) error {
+	_, err := theDB.Exec(
+		`INSERT INTO fileversion (path, name, version, uploader, created)
+		 SELECT ?, ?, coalesce(max(version), 0) + 1, ?, ? FROM fileversion WHERE path = ? AND name = ?`,
+		parentDir+"/", name, uploader, created.UTC().Format(time.RFC3339),
+		parentDir+"/", name,
+	)
+	return err
+}
+
+// Keep the current content and move its derived files out of the way, before it is overwritten.
+// The content is linked rather than moved, so it is still served until the new upload replaces it.
+// Files written before versions were kept get recorded as version 1 with no uploader.
+func preserveVersion(parentDir string, name string) error {
+	return preserveVersionOf("."+parentDir, parentDir, name)
+}
+
+// Keep the content of parentDir/name that is in fsDir as its current version,
+// such as from the tree that an install has just replaced
+func preserveVersionOf(fsDir string, parentDir string, name string) error {
+	s, err := os.Stat(fsDir + "/" + name)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	current, err := currentVersion(parentDir, name)
+	if err != nil {
+		return err
+	}
+	if current == 0 {
+		err = recordVersion(parentDir, name, "", s.ModTime())
+		if err != nil {
+			return err
+		}
+		current = 1
+	}
+
+	dir := versionDir(parentDir, name, current)
+	err = os.MkdirAll(dir, 0777)
+	if err != nil {
+		return err
+	}
+	os.Remove(dir + "/" + name)
+	err = os.Link(fsDir+"/"+name, dir+"/"+name)
+	if err != nil {
+		return err
+	}
+	size := s.Size()
+	for _, n := range derivedNames(name) {
+		err = os.Rename(fsDir+"/"+n, dir+"/"+n)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if d, err := os.Stat(dir + "/" + n); err == nil {
+			size += d.Size()
+		}
+	}
+	// What is kept still counts against quotas
+	_, err = theDB.Exec(
+		`UPDATE fileversion SET contentSize = ? WHERE path = ? AND name = ? AND version = ?`,
+		size, parentDir+"/", name, current,
+	)
+	return err
+}
+
+// ?versions=true on a file lists its versions, the last of which is what is served now
+func getVersionsHandler(w http.ResponseWriter, r *http.Request, parentDir string, name string) {
+	rows, err := theDB.Query(
+		`SELECT version, uploader, created FROM fileversion WHERE path = ? AND name = ? ORDER BY version`,
+		parentDir+"/", name,
+	)
+	if err != nil {
+		HandleError(w, err, "Could not list versions of %s: %v", parentDir+"/"+name)
+		return
+	}
+	defer rows.Close()
+	versions := []FileVersion{}
+	for rows.Next() {
+		var v FileVersion
+		rows.Scan(&v.Version, &v.Uploader, &v.Created)
+		versions = append(versions, v)
+	}
+	for i := range versions {
+		fName := versionDir(parentDir, name, versions[i].Version) + "/" + name
+		if i == len(versions)-1 {
+			fName = "." + parentDir + "/" + name
+			versions[i].Current = true
+		}
+		if s, err := os.Stat(fName); err == nil {
+			versions[i].Size = s.Size()
+		}
+	}
+
+	q := r.URL.Query()
+	inJson := q.Get("json") == "true"
+	if inJson {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(AsJson(versions)))
+	} else {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<ul>` + "\n"))
+		for _, v := range versions {
+			current := ""
+			if v.Current {
+				current = " (current)"
+			}
+			w.Write([]byte(fmt.Sprintf(
+				`  <li><a href="%s?version=%d">version %d</a>%s %s %s%s`+"\n",
+				name, v.Version, v.Version, getSizeUnits(v.Size, false), v.Created, v.Uploader, current,
+			)))
+		}
+		w.Write([]byte(`</ul>` + "\n"))
+	}
+}
+
+// Find the file for ?version=N, which may be a derived file of that version, such as its thumbnail.
+// Returns "" for the current version, which is served like any other file.
+func versionFile(parentDir string, name string, version string) (string, error) {
+	n, err := strconv.Atoi(version)
+	if err != nil {
+		return "", ErrNoVersion
+	}
+	original := OriginalName(name)
+	current, err := currentVersion(parentDir, original)
+	if err != nil {
+		return "", err
+	}
+	if n == current {
+		return "", nil
+	}
+	fName := versionDir(parentDir, original, n) + "/" + name
+	if _, err := os.Stat(fName); err != nil {
+		return "", ErrNoVersion
+	}
+	return fName, nil
+}
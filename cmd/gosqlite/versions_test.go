@@ -0,0 +1,24 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+// Every version is still found by its new name once a file is moved
+func TestVersionsAfterMove(t *testing.T) {
+	testServer(t)
+	testStatus(t, http.MethodPost, "/files/robf/a.txt", testAdmin, "first", http.StatusOK)
+	testStatus(t, http.MethodPost, "/files/robf/a.txt", testAdmin, "second", http.StatusOK)
+	testStatus(t, http.MethodPost, "/files/robf/a.txt", testAdmin, "third", http.StatusOK)
+
+	testStatus(t, http.MethodPost, "/move/robf/a.txt?to=/files/robf/b.txt", testAdmin, "", http.StatusOK)
+	testStatus(t, http.MethodPost, "/move/robf/b.txt?to=/files/robf/docs/c.txt", testAdmin, "", http.StatusOK)
+	for version, want := range map[string]string{"1": "first", "2": "second", "3": "third"} {
+		w := testStatus(t, http.MethodGet, "/files/robf/docs/c.txt?version="+version, testAdmin, "", http.StatusOK)
+		if w.Body.String() != want {
+			t.Errorf("version %s is %q, want %q", version, w.Body.String(), want)
+		}
+	}
+	testStatus(t, http.MethodGet, "/files/robf/a.txt?version=1", testAdmin, "", http.StatusNotFound)
+}
@@ -4,6 +4,7 @@ go 1.18
 
 require (
 	cloud.google.com/go/vision v1.2.0
+	github.com/klauspost/compress v1.15.9
 	github.com/mattn/go-sqlite3 v1.14.12
 	github.com/open-policy-agent/opa v0.41.0
 )
@@ -38,7 +38,9 @@
 
   GET /list/robf/docs
        list - returns an array of hits, in paging metadata
-              or as html links, depending on args
+              or as html links, depending on args.
+              It is answered from filemeta rather than the filesystem:
+              ?recursive=true&sort=modified&order=desc&limit=20&offset=40&json=true
   GET /files/robf/docs/resume.pdf
        files - streams of files.  Served straightforwardly
                off of the filesystem with http.FileServer
@@ -46,18 +48,98 @@
   GET /permission/robf/docs/resume.pdf
        permission - probably rego language
  */
+/*
+  Every file written under ./files has a row, kept up through uploads,
+  appends, installs, moves and deletes.
+  Content is stored once in ./blobs by sha256, and files in ./files are
+  hard links to it.  sha256 is also served as the ETag.
+  derivedOf is the name of the file beside it that a thumbnail, extract,
+  labels, attributes or permission belongs to.
+  contentType is detected from the extension, or else the content, when it
+  is written.  It decides what is derived, and is served as Content-Type.
+ */
 CREATE TABLE `filemeta` (
 	`id` INTEGER PRIMARY KEY AUTOINCREMENT,
 	`cmd` TEXT,
 	`path` TEXT,
 	`name` TEXT,
       `contentType` TEXT,
+      `contentSize` INTEGER,
+      `sha256` TEXT,
+      `uploader` TEXT,
+      `created` TEXT,
+      `modified` TEXT,
+      `derivedOf` TEXT
+);
+
+/*
+  Every upload to /files is a new version.  What it overwrote is kept
+  under ./versions, along with whatever was derived from it.
+
+  GET /files/robf/docs/resume.pdf?versions=true
+  GET /files/robf/docs/resume.pdf?version=3
+  POST /files/robf/docs/resume.pdf?version=3
+       restores version 3 by uploading it again as the newest version
+
+  contentSize is what is kept under ./versions once a version is overwritten,
+  which still counts against quotas.
+ */
+CREATE TABLE `fileversion` (
+	`id` INTEGER PRIMARY KEY AUTOINCREMENT,
+	`path` TEXT,
+	`name` TEXT,
+	`version` INTEGER,
+	`uploader` TEXT,
+	`created` TEXT,
       `contentSize` INTEGER
 );
 
 /*
-  GET /search/robf/docs/resume.pdf?q=Rob+Fielding
-       search - returns the same format of a listing, of urls that hit
+  Every accepted permission is kept, so that a bad policy can be rolled back.
+  The latest version is also on disk, beside what it governs.
+
+  GET /permission/robf/docs/resume.pdf?versions=true
+  GET /permission/robf/docs/resume.pdf?version=3
+ */
+CREATE TABLE `permissionversion` (
+	`id` INTEGER PRIMARY KEY AUTOINCREMENT,
+	`path` TEXT,
+	`name` TEXT,
+	`version` INTEGER,
+	`content` TEXT,
+	`author` TEXT,
+	`created` TEXT
+);
+
+/*
+  Deriving thumbnails, extracts and labels is queued, so that uploads
+  do not wait for it.  A failed job is queued again with a later due time,
+  until it has used up its attempts.
+
+  GET /jobs/robf/docs/resume.pdf
+  GET /jobs/robf/docs/?state=failed&json=true
+ */
+CREATE TABLE `job` (
+	`id` INTEGER PRIMARY KEY AUTOINCREMENT,
+	`path` TEXT,
+	`name` TEXT,
+	`state` TEXT,
+	`attempts` INTEGER,
+	`error` TEXT,
+	`uploader` TEXT,
+	`created` TEXT,
+	`updated` TEXT,
+	`due` TEXT
+);
+
+/*
+  GET /search/robf/docs/resume.pdf?match=Rob+Fielding
+       search - returns the same format of a listing, of urls that hit.
+                Only original_path under /files/robf/docs/ is searched,
+                or only resume.pdf when it is a file.  recursive=false
+                leaves out subdirectories.
+                Each part of a text file records where it is in the file,
+                so that a hit links to /files/robf/notes.txt?offset=4096&length=4021
  */
 CREATE VIRTUAL TABLE `filesearch` USING FTS5(
 	`id`,
@@ -67,5 +149,7 @@ CREATE VIRTUAL TABLE `filesearch` USING FTS5(
 	`part`,
       `original_path`,
       `original_name`,
-	`content`
+	`content`,
+	`content_offset` UNINDEXED,
+	`content_length` UNINDEXED
 );